@@ -0,0 +1,177 @@
+package toydb
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+)
+
+// WriteBatch collects Puts and Deletes to apply together with Apply. The zero value is an
+// empty batch ready to use. Put and DeleteBytes keep the slices they are given, so they
+// must not be changed until Apply has returned
+type WriteBatch struct {
+	operations []batchOperation
+}
+
+type batchOperation struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (b *WriteBatch) Put(key []byte, value []byte) {
+	b.operations = append(b.operations, batchOperation{key: key, value: value})
+}
+
+// Set is Put for string keys and values
+func (b *WriteBatch) Set(key string, value string) {
+	b.Put([]byte(key), []byte(value))
+}
+
+func (b *WriteBatch) DeleteBytes(key []byte) {
+	b.operations = append(b.operations, batchOperation{key: key, delete: true})
+}
+
+// Delete is DeleteBytes for string keys
+func (b *WriteBatch) Delete(key string) {
+	b.DeleteBytes([]byte(key))
+}
+
+// Len returns the number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.operations)
+}
+
+// Reset empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.operations = b.operations[:0]
+}
+
+// batchToWrite holds the hashed keys and encoded entries of a batch, deletes have no entry
+type batchToWrite struct {
+	keys            [][]byte
+	entries         [][]byte
+	responseChannel chan error
+}
+
+type batchToMap struct {
+	keys            [][]byte
+	dataInfos       []dataInfo
+	responseChannel chan error
+}
+
+// Apply writes every operation in the batch in order, a later operation on a key wins.
+// The batch takes one trip through the processors: its values are written to the data
+// file in one go, followed by a batch header and all of its map records. Get sees either
+// none of the batch or all of it, and after a crash it is recovered whole or not at all
+func (eng *StorageEngine) Apply(batch *WriteBatch) error {
+	return eng.ApplyContext(context.Background(), batch)
+}
+
+// ApplyContext is Apply that gives up when ctx is done, like SetContext
+func (eng *StorageEngine) ApplyContext(ctx context.Context, batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	responseChannel := make(chan error, 1)
+	writeBatch := batchToWrite{
+		keys:            make([][]byte, len(batch.operations)),
+		entries:         make([][]byte, len(batch.operations)),
+		responseChannel: responseChannel,
+	}
+	for i, operation := range batch.operations {
+		if len(operation.key) > maxKeyLength {
+			return ErrKeyTooLarge
+		}
+		hashedKey := sha256.Sum256(operation.key)
+		writeBatch.keys[i] = hashedKey[:]
+		if !operation.delete {
+			entry, err := eng.encodeEntry(operation.key, operation.value)
+			if err != nil {
+				return err
+			}
+			writeBatch.entries[i] = entry
+		}
+	}
+	select {
+	case eng.dataBatchChannel <- writeBatch:
+	case <-eng.shutdownTriggerChannel:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return eng.waitForWrite(ctx, "Apply", responseChannel)
+}
+
+// writeBatchData is the data processor's half of Apply
+func (eng *StorageEngine) writeBatchData(batch batchToWrite) {
+	if err := eng.stoppedError(); err != nil {
+		batch.responseChannel <- err
+		return
+	}
+	var batchLength int64
+	for _, entry := range batch.entries {
+		batchLength += int64(len(entry))
+	}
+	// the whole batch goes in one segment
+	if err := eng.rollSegment(batchLength); err != nil {
+		log.Printf("Error starting data segment: %s\n", err.Error())
+		batch.responseChannel <- err
+		return
+	}
+	toWrite := make([]byte, 0, batchLength)
+	infos := make([]dataInfo, len(batch.entries))
+	for i, entry := range batch.entries {
+		if entry == nil {
+			infos[i] = dataInfo{0, 0, tombstoneLength, 0}
+			continue
+		}
+		infos[i] = dataInfo{eng.dataSegment, eng.dataFileLength + int64(len(toWrite)), int64(len(entry)), 0}
+		toWrite = append(toWrite, entry...)
+	}
+	bytesWritten, err := eng.dataFile.Write(toWrite)
+	if err != nil {
+		log.Printf("Error writing batch data: %s\n", err.Error())
+		eng.undoDataWrite()
+		batch.responseChannel <- err
+		return
+	}
+	eng.dataFileLength += int64(bytesWritten)
+	select {
+	case eng.mapBatchChannel <- batchToMap{batch.keys, infos, batch.responseChannel}:
+	case <-eng.shutdownTriggerChannel:
+		batch.responseChannel <- ErrClosed
+	}
+}
+
+// writeBatchMap is the map processor's half of Apply
+func (eng *StorageEngine) writeBatchMap(batch batchToMap) {
+	if err := eng.stoppedError(); err != nil {
+		batch.responseChannel <- err
+		return
+	}
+	toWrite := make([]byte, 0, (len(batch.keys)+1)*mapRecordLength)
+	var noKey [32]byte
+	toWrite = append(toWrite, encodeMapRecord(noKey[:], dataInfo{0, int64(len(batch.keys)), batchHeaderLength, 0})...)
+	for i, key := range batch.keys {
+		toWrite = append(toWrite, encodeMapRecord(key, batch.dataInfos[i])...)
+	}
+	bytesWritten, err := eng.mapFile.Write(toWrite)
+	if err != nil {
+		log.Printf("Error writing batch map data: %s\n", err.Error())
+		eng.undoMapWrite()
+		batch.responseChannel <- err
+		return
+	}
+	eng.mapFileLength += int64(bytesWritten)
+	// Get holds filesLock for reading, so no Get runs while only part of the batch is in
+	// the offset map
+	eng.filesLock.Lock()
+	for i, hashedKey := range batch.keys {
+		var key [32]byte
+		copy(key[:], hashedKey[0:32])
+		eng.offsetMap.set(key, batch.dataInfos[i])
+	}
+	eng.filesLock.Unlock()
+	eng.completeWrite(batch.responseChannel)
+}
@@ -0,0 +1,130 @@
+package toydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_StorageEngine_Apply_writesEveryOperation(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("gone", "value")
+
+	var batch WriteBatch
+	batch.Set("a", "1")
+	batch.Set("b", "2")
+	batch.Delete("gone")
+	batch.Put([]byte("a"), []byte("3"))
+	shouldEqual(t, storageEngine.Apply(&batch), nil)
+
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("3"))
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("2"))
+	_, err := storageEngine.Get("gone")
+	shouldEqual(t, err, ErrNotFound)
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	a, _ = storageEngine.Get("a")
+	shouldEqual(t, a, []byte("3"))
+	_, err = storageEngine.Get("gone")
+	shouldEqual(t, err, ErrNotFound)
+}
+
+func Test_StorageEngine_Apply_writesNothingForEmptyBatch(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Apply(&WriteBatch{}), nil)
+	shouldEqual(t, storageEngine.mapFileLength, int64(fileHeaderLength))
+}
+
+func Test_WriteBatch_Reset_emptiesBatch(t *testing.T) {
+	var batch WriteBatch
+	batch.Set("a", "1")
+	batch.Delete("b")
+	shouldEqual(t, batch.Len(), 2)
+
+	batch.Reset()
+	shouldEqual(t, batch.Len(), 0)
+}
+
+func writeTestBatch(t *testing.T, dir string, keys ...string) {
+	storageEngine := openTestEngine(t, dir)
+	var batch WriteBatch
+	for _, key := range keys {
+		batch.Set(key, "value-"+key)
+	}
+	if err := storageEngine.Apply(&batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+	storageEngine.Shutdown()
+}
+
+func Test_recoverFiles_dropsBatchCutShort(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	writeTestBatch(t, dir, "b", "c", "d")
+	mapPath := filepath.Join(dir, "map")
+	info, _ := os.Stat(mapPath)
+	os.Truncate(mapPath, info.Size()-mapRecordLength-10)
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.mapLength, int64(fileHeaderLength+mapRecordLength))
+	shouldEqual(t, state.report.MapBytesTruncated, int64(3*mapRecordLength-10))
+	shouldEqual(t, state.dataLength, int64(fileHeaderLength+len(encodeDataEntry([]byte("a"), []byte("value-a")))))
+	shouldEqual(t, len(state.offsetMap), 1)
+}
+
+func Test_recoverFiles_dropsBatchWithTornLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	writeTestBatch(t, dir, "b", "c")
+	file, _ := os.OpenFile(filepath.Join(dir, "map"), os.O_WRONLY, 0)
+	file.WriteAt(make([]byte, 10), fileHeaderLength+4*mapRecordLength-10)
+	file.Close()
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report.MapBytesTruncated, int64(3*mapRecordLength))
+	shouldEqual(t, len(state.offsetMap), 1)
+}
+
+func Test_recoverFiles_dropsBatchWhenOneValueIsMissing(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	writeTestBatch(t, dir, "b", "c")
+	dataPath := filepath.Join(dir, "data")
+	info, _ := os.Stat(dataPath)
+	os.Truncate(dataPath, info.Size()-5)
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report.MapBytesTruncated, int64(3*mapRecordLength))
+	shouldEqual(t, state.dataLength, int64(fileHeaderLength+len(encodeDataEntry([]byte("a"), []byte("value-a")))))
+	shouldEqual(t, len(state.offsetMap), 1)
+}
+
+func Test_StorageEngine_Compact_keepsBatchWrittenBeforeCompaction(t *testing.T) {
+	dir := t.TempDir()
+	writeTestBatch(t, dir, "a", "b")
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	err := storageEngine.Compact()
+
+	shouldEqual(t, err, nil)
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("value-b"))
+}
@@ -0,0 +1,221 @@
+// Package client talks to a ToyDB server over its RESP2 protocol.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	toydb "github.com/oscarrobinson/ToyDB"
+)
+
+var _ toydb.Store = (*Client)(nil)
+
+var ErrClientClosed = errors.New("toydb client: closed")
+
+// ServerError is an error reply sent back by the server
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+type Options struct {
+	// MaxIdleConns is how many connections are kept open for reuse, defaults to 4
+	MaxIdleConns int
+	// DialTimeout bounds connecting when the context has no earlier deadline, defaults to 5 seconds
+	DialTimeout time.Duration
+}
+
+type Client struct {
+	address string
+	options Options
+	dialer  net.Dialer
+	mutex   sync.Mutex
+	idle    []*conn
+	closed  bool
+}
+
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+}
+
+func New(address string) *Client {
+	return NewWithOptions(address, Options{})
+}
+
+func NewWithOptions(address string, options Options) *Client {
+	if options.MaxIdleConns <= 0 {
+		options.MaxIdleConns = 4
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = 5 * time.Second
+	}
+	client := new(Client)
+	client.address = address
+	client.options = options
+	client.dialer.Timeout = options.DialTimeout
+	return client
+}
+
+func (c *Client) Get(key string) ([]byte, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *Client) Set(key string, value string) error {
+	return c.SetContext(context.Background(), key, value)
+}
+
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// GetContext returns toydb.ErrNotFound when the key is not set, like StorageEngine.Get
+func (c *Client) GetContext(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, toydb.ErrNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, errUnexpectedReply
+	}
+	return value, nil
+}
+
+func (c *Client) SetContext(ctx context.Context, key string, value string) error {
+	_, err := c.do(ctx, "SET", key, value)
+	return err
+}
+
+func (c *Client) SetWithTTL(key string, value string, ttl time.Duration) error {
+	return c.SetWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLContext sends the ttl in whole milliseconds, rounded up so a ttl under a
+// millisecond still expires the key rather than keeping it
+func (c *Client) SetWithTTLContext(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return toydb.ErrInvalidTTL
+	}
+	milliseconds := (ttl + time.Millisecond - 1) / time.Millisecond
+	_, err := c.do(ctx, "SET", key, value, "PX", strconv.FormatInt(int64(milliseconds), 10))
+	return err
+}
+
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DEL", key)
+	return err
+}
+
+// Close closes the pooled connections, requests already running finish on their own connection
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.closed = true
+	c.mutex.Unlock()
+	for _, cn := range idle {
+		cn.netConn.Close()
+	}
+	return nil
+}
+
+// do sends one command and reads its reply. A pooled connection may have been closed
+// by the server since it was last used, so a failure on one is retried once on a fresh
+// connection
+func (c *Client) do(ctx context.Context, args ...string) (interface{}, error) {
+	cn, pooled, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.roundTrip(ctx, cn, args)
+	if err != nil && pooled && ctx.Err() == nil && err != context.DeadlineExceeded && !isServerError(err) {
+		cn, err = c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		reply, err = c.roundTrip(ctx, cn, args)
+	}
+	return reply, err
+}
+
+func (c *Client) roundTrip(ctx context.Context, cn *conn, args []string) (interface{}, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	cn.netConn.SetDeadline(deadline)
+	// cancelling the context expires the deadline so blocked reads and writes return
+	stop := context.AfterFunc(ctx, func() {
+		cn.netConn.SetDeadline(time.Unix(1, 0))
+	})
+	reply, err := cn.exchange(args)
+	if !stop() || (err != nil && !isServerError(err)) {
+		cn.netConn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		// the socket deadline can fire just before the context notices it has expired
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && hasDeadline {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	c.putConn(cn)
+	return reply, err
+}
+
+func (cn *conn) exchange(args []string) (interface{}, error) {
+	writeCommand(cn.writer, args)
+	if err := cn.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(cn.reader)
+}
+
+func (c *Client) getConn(ctx context.Context) (*conn, bool, error) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, false, ErrClientClosed
+	}
+	if last := len(c.idle) - 1; last >= 0 {
+		cn := c.idle[last]
+		c.idle = c.idle[:last]
+		c.mutex.Unlock()
+		return cn, true, nil
+	}
+	c.mutex.Unlock()
+	cn, err := c.dial(ctx)
+	return cn, false, err
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	netConn, err := c.dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{netConn, bufio.NewReader(netConn), bufio.NewWriter(netConn)}, nil
+}
+
+func (c *Client) putConn(cn *conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed || len(c.idle) >= c.options.MaxIdleConns {
+		cn.netConn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func isServerError(err error) bool {
+	_, ok := err.(ServerError)
+	return ok
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	toydb "github.com/oscarrobinson/ToyDB"
+)
+
+func shouldEqual(t *testing.T, got interface{}, expected interface{}) {
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("%v did not equal expected %v", got, expected)
+	}
+}
+
+func startServer(t *testing.T, address string) (*toydb.Server, string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	dir := t.TempDir()
+	engine, err := toydb.Open(toydb.StorageEngineConfig{
+		MapFilePath:  filepath.Join(dir, "map"),
+		DataFilePath: filepath.Join(dir, "data")})
+	if err != nil {
+		t.Fatalf("Failed to open engine: %v", err)
+	}
+	server := toydb.NewServer(engine)
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+func Test_Client_setThenGetReturnsValue(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	defer server.Shutdown()
+	client := New(address)
+	defer client.Close()
+
+	shouldEqual(t, client.Set("testkey", "some\r\ndata"), nil)
+	value, err := client.Get("testkey")
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("some\r\ndata"))
+}
+
+func Test_Client_Get_returnsErrNotFoundWhenKeyNotFound(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	defer server.Shutdown()
+	client := New(address)
+	defer client.Close()
+
+	value, err := client.Get("missing")
+
+	shouldEqual(t, err, toydb.ErrNotFound)
+	shouldEqual(t, value == nil, true)
+}
+
+func Test_Client_Delete_removesKey(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	defer server.Shutdown()
+	client := New(address)
+	defer client.Close()
+
+	client.Set("testkey", "somedata")
+	shouldEqual(t, client.Delete("testkey"), nil)
+	value, err := client.Get("testkey")
+
+	shouldEqual(t, err, toydb.ErrNotFound)
+	shouldEqual(t, value == nil, true)
+}
+
+func Test_Client_SetWithTTL_expiresKey(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	defer server.Shutdown()
+	client := New(address)
+	defer client.Close()
+
+	shouldEqual(t, client.SetWithTTL("long", "value", time.Hour), nil)
+	shouldEqual(t, client.SetWithTTL("short", "value", time.Microsecond), nil)
+	shouldEqual(t, client.SetWithTTL("invalid", "value", 0), toydb.ErrInvalidTTL)
+	time.Sleep(5 * time.Millisecond)
+
+	value, err := client.Get("long")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("value"))
+	_, err = client.Get("short")
+	shouldEqual(t, err, toydb.ErrNotFound)
+}
+
+func Test_Client_reusesPooledConnections(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	defer server.Shutdown()
+	client := New(address)
+	defer client.Close()
+
+	client.Set("a", "1")
+	firstConn := client.idle[0]
+	client.Get("a")
+
+	shouldEqual(t, len(client.idle), 1)
+	shouldEqual(t, client.idle[0] == firstConn, true)
+}
+
+func Test_Client_reconnectsAfterServerRestart(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	client := New(address)
+	defer client.Close()
+	shouldEqual(t, client.Set("a", "1"), nil)
+
+	server.Shutdown()
+	server, _ = startServer(t, address)
+	defer server.Shutdown()
+
+	shouldEqual(t, client.Set("b", "2"), nil)
+	value, err := client.Get("b")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("2"))
+}
+
+func Test_Client_GetContext_returnsDeadlineExceededWhenServerHangs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go (func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	})()
+	client := New(listener.Addr().String())
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.GetContext(ctx, "testkey")
+
+	shouldEqual(t, err, context.DeadlineExceeded)
+	shouldEqual(t, len(client.idle), 0)
+}
+
+func Test_Client_returnsServerErrorReplies(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	defer server.Shutdown()
+	client := New(address)
+	defer client.Close()
+
+	_, err := client.do(context.Background(), "NOPE")
+
+	shouldEqual(t, err, ServerError("ERR unknown command 'NOPE'"))
+	shouldEqual(t, len(client.idle), 1)
+}
+
+func Test_Client_returnsErrClientClosedAfterClose(t *testing.T) {
+	client := New("127.0.0.1:1")
+	client.Close()
+
+	_, err := client.Get("a")
+
+	shouldEqual(t, err, ErrClientClosed)
+}
+
+func Test_Client_Get_returnsEmptyValueForKeySetToEmptyString(t *testing.T) {
+	server, address := startServer(t, "127.0.0.1:0")
+	defer server.Shutdown()
+	client := New(address)
+	defer client.Close()
+
+	client.Set("empty", "")
+	value, err := client.Get("empty")
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte{})
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+var errUnexpectedReply = errors.New("toydb client: unexpected reply from server")
+
+func writeCommand(writer *bufio.Writer, args []string) {
+	writer.WriteByte('*')
+	writer.WriteString(strconv.Itoa(len(args)))
+	writer.WriteString("\r\n")
+	for _, arg := range args {
+		writer.WriteByte('$')
+		writer.WriteString(strconv.Itoa(len(arg)))
+		writer.WriteString("\r\n")
+		writer.WriteString(arg)
+		writer.WriteString("\r\n")
+	}
+}
+
+// readReply returns a string for simple strings, an int64 for integers, a []byte for bulk
+// strings (nil for the null bulk string) and an []interface{} for arrays. Error replies
+// are returned as a ServerError, or held as one inside an array
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\r\n"))
+	if len(line) == 0 {
+		return nil, errUnexpectedReply
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, ServerError(line[1:])
+	case ':':
+		value, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, errUnexpectedReply
+		}
+		return value, nil
+	case '$':
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length < -1 {
+			return nil, errUnexpectedReply
+		}
+		if length == -1 {
+			return nil, nil
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:length], nil
+	case '*':
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length < -1 {
+			return nil, errUnexpectedReply
+		}
+		if length == -1 {
+			return nil, nil
+		}
+		values := make([]interface{}, length)
+		for i := range values {
+			value, err := readReply(reader)
+			if isServerError(err) {
+				value = err
+			} else if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	default:
+		return nil, errUnexpectedReply
+	}
+}
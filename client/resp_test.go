@@ -0,0 +1,43 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_writeCommand_writesArrayOfBulkStrings(t *testing.T) {
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+
+	writeCommand(writer, []string{"SET", "key", ""})
+	writer.Flush()
+
+	shouldEqual(t, buf.String(), "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n")
+}
+
+func Test_readReply_parsesEachReplyType(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader(
+		"+OK\r\n:42\r\n$5\r\nva\r\nl\r\n$-1\r\n*3\r\n$1\r\na\r\n$-1\r\n-ERR inner\r\n-ERR broken\r\n"))
+
+	reply, err := readReply(reader)
+	shouldEqual(t, reply, "OK")
+	reply, err = readReply(reader)
+	shouldEqual(t, reply, int64(42))
+	reply, err = readReply(reader)
+	shouldEqual(t, reply, []byte("va\r\nl"))
+	reply, err = readReply(reader)
+	shouldEqual(t, reply, nil)
+	reply, err = readReply(reader)
+	shouldEqual(t, reply, []interface{}{[]byte("a"), nil, ServerError("ERR inner")})
+	shouldEqual(t, err, nil)
+	_, err = readReply(reader)
+	shouldEqual(t, err, ServerError("ERR broken"))
+}
+
+func Test_readReply_returnsErrorForUnknownReplyType(t *testing.T) {
+	_, err := readReply(bufio.NewReader(strings.NewReader("?what\r\n")))
+
+	shouldEqual(t, err, errUnexpectedReply)
+}
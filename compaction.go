@@ -0,0 +1,369 @@
+package toydb
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// pause stops both processors once they have finished what they are working on and
+// returns a function that starts them again. While paused the caller owns the files,
+// their lengths and the offset map. The data processor hands every value it has taken
+// to the map processor before it can be paused, so no Set is left half written. Once
+// Shutdown has been called it returns ErrClosed instead
+func (eng *StorageEngine) pause() (func(), error) {
+	resume := make(chan struct{})
+	select {
+	case eng.dataPauseChannel <- resume:
+	case <-eng.shutdownTriggerChannel:
+		return nil, ErrClosed
+	}
+	select {
+	case eng.mapPauseChannel <- resume:
+	case <-eng.shutdownTriggerChannel:
+		// let the data processor go so it can shut down
+		close(resume)
+		return nil, ErrClosed
+	}
+	return func() { close(resume) }, nil
+}
+
+type compactor struct {
+	segments  map[uint32]EngineFile
+	mapOut    *bufio.Writer
+	offsetMap map[[32]byte]dataInfo
+	mapLength int64
+	// the new data segments, values go to the last one until it would pass segmentSize
+	dataPath    string
+	outputs     []*os.File
+	dataOut     *bufio.Writer
+	dataLength  int64
+	segmentSize int64
+	// rewrites each entry on its way to the new data file, nil copies them as they are
+	reencode func(entry []byte, offset int64) ([]byte, error)
+}
+
+// nextOutput starts the next new data segment, the same way rollSegment does for writes
+func (c *compactor) nextOutput() error {
+	if c.dataOut != nil {
+		if err := c.dataOut.Flush(); err != nil {
+			return err
+		}
+	}
+	file, err := createFile(SegmentPath(c.dataPath, uint32(len(c.outputs))))
+	if err != nil {
+		return err
+	}
+	c.outputs = append(c.outputs, file)
+	c.dataOut = bufio.NewWriter(file)
+	c.dataLength = fileHeaderLength
+	_, err = c.dataOut.Write(encodeFileHeader("data", time.Now()))
+	return err
+}
+
+// finishOutputs flushes the new data segments and syncs them to disk
+func (c *compactor) finishOutputs() error {
+	if err := c.dataOut.Flush(); err != nil {
+		return err
+	}
+	for _, file := range c.outputs {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compactor) copyValue(key [32]byte, info dataInfo) error {
+	value := make([]byte, info.length)
+	if _, err := c.segments[info.segment].ReadAt(value, info.offset); err != nil {
+		return err
+	}
+	if _, _, _, err := splitDataEntry(value, info.offset); err != nil {
+		return err
+	}
+	if c.reencode != nil {
+		var err error
+		if value, err = c.reencode(value, info.offset); err != nil {
+			return err
+		}
+	}
+	length := int64(len(value))
+	if c.segmentSize > 0 && c.dataLength > fileHeaderLength && c.dataLength+length > c.segmentSize {
+		if err := c.nextOutput(); err != nil {
+			return err
+		}
+	}
+	if _, err := c.dataOut.Write(value); err != nil {
+		return err
+	}
+	newInfo := dataInfo{uint32(len(c.outputs) - 1), c.dataLength, length, info.expiry}
+	c.dataLength += newInfo.length
+	if err := c.writeRecord(key, newInfo); err != nil {
+		return err
+	}
+	c.offsetMap[key] = newInfo
+	return nil
+}
+
+func (c *compactor) writeRecord(key [32]byte, info dataInfo) error {
+	bytesWritten, err := c.mapOut.Write(encodeMapRecord(key[:], info))
+	c.mapLength += int64(bytesWritten)
+	return err
+}
+
+// Compact copies only the live values into new files and swaps them in for the old map
+// file and data segments, which are deleted along with the hint to reclaim their space.
+// The values are split into new segments of up to SegmentSize the same way writes are.
+// Get, Set and Delete keep working while the values are copied, they only wait for the
+// final switch over. The new files are written next to the old ones with a .compact
+// suffix and only take their place once every one of them is on disk, so a crash leaves
+// either the old files or the new ones, never a mix. Open finishes the swap if it was
+// interrupted. The engine has to have been given MapFilePath and DataFilePath
+func (eng *StorageEngine) Compact() error {
+	return eng.compact(nil)
+}
+
+func (eng *StorageEngine) compact(reencode func(entry []byte, offset int64) ([]byte, error)) error {
+	if eng.mapFilePath == "" || eng.dataFilePath == "" {
+		return ErrMissingFilePath
+	}
+	eng.compactionMutex.Lock()
+	defer eng.compactionMutex.Unlock()
+
+	resume, err := eng.pause()
+	if err != nil {
+		return err
+	}
+	snapshot := eng.offsetMap.snapshot()
+	snapshotMapLength := eng.mapFileLength
+	oldMapFile := eng.mapFile
+	resume()
+
+	mapTemp := eng.mapFilePath + compactionSuffix
+	mapFile, err := createFile(mapTemp)
+	if err != nil {
+		return err
+	}
+	c := compactor{
+		segments:    eng.copySegments(),
+		mapOut:      bufio.NewWriter(mapFile),
+		offsetMap:   make(map[[32]byte]dataInfo, len(snapshot)),
+		mapLength:   fileHeaderLength,
+		dataPath:    eng.dataFilePath + compactionSuffix,
+		segmentSize: eng.segmentSize,
+		reencode:    reencode,
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			mapFile.Close()
+			for _, file := range c.outputs {
+				file.Close()
+			}
+			removeCompactionFiles(eng.mapFilePath, eng.dataFilePath)
+		}
+	}()
+	now := time.Now()
+	c.mapOut.Write(encodeFileHeader("map", now))
+	if err := c.nextOutput(); err != nil {
+		return err
+	}
+	for key, info := range snapshot {
+		if info.expired(now.UnixNano()) {
+			continue
+		}
+		if err := c.copyValue(key, info); err != nil {
+			return err
+		}
+	}
+
+	resume, err = eng.pause()
+	if err != nil {
+		return err
+	}
+	defer resume()
+	// replay whatever was written while the values were being copied, which may have gone
+	// into new segments
+	c.segments = eng.copySegments()
+	var tailErr error
+	_, err = forEachMapRecord(io.NewSectionReader(oldMapFile, 0, eng.mapFileLength), snapshotMapLength, func(records []mapRecord) bool {
+		for _, record := range records {
+			// an expired value is dropped like a deleted one, the tombstone stops an older
+			// copy of the key coming back
+			if record.info.isTombstone() || record.info.expired(now.UnixNano()) {
+				delete(c.offsetMap, record.keyHash)
+				tailErr = c.writeRecord(record.keyHash, dataInfo{0, 0, tombstoneLength, 0})
+			} else {
+				tailErr = c.copyValue(record.keyHash, record.info)
+			}
+			if tailErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if tailErr != nil {
+		return tailErr
+	}
+	if err := c.finishOutputs(); err != nil {
+		return err
+	}
+	if err := c.mapOut.Flush(); err != nil {
+		return err
+	}
+	if err := mapFile.Sync(); err != nil {
+		return err
+	}
+	// every new file is on disk, from here on the compaction is finished rather than
+	// thrown away
+	if err := os.Rename(mapTemp, eng.mapFilePath+compactedSuffix); err != nil {
+		return err
+	}
+	if err := syncDirectory(eng.mapFilePath); err != nil {
+		return err
+	}
+	committed = true
+
+	eng.filesLock.Lock()
+	eng.mapFile = mapFile
+	eng.mapFileLength = c.mapLength
+	// the new segments take the ids of the old ones, which are deleted as they are
+	// installed, and writes carry on in the last of them
+	eng.segments = make(map[uint32]EngineFile, len(c.outputs))
+	for id, file := range c.outputs {
+		eng.segments[uint32(id)] = eng.mapSegment(file)
+	}
+	eng.dataSegment = uint32(len(c.outputs) - 1)
+	eng.dataFile = eng.segments[eng.dataSegment]
+	eng.nextSegment = eng.dataSegment + 1
+	eng.dataFileLength = c.dataLength
+	eng.offsetMap = newOffsetIndexFromMap(c.offsetMap)
+	eng.filesLock.Unlock()
+
+	installErr := installCompaction(eng.mapFilePath, eng.dataFilePath)
+	if installErr != nil {
+		// the open files are the new ones but some still have their .compact names, a
+		// write now could go to a segment the next Open deletes
+		eng.stopWrites(installErr)
+	}
+	for _, segment := range c.segments {
+		if err := segment.Close(); err != nil && installErr == nil {
+			installErr = err
+		}
+	}
+	if err := oldMapFile.Close(); err != nil && installErr == nil {
+		installErr = err
+	}
+	return installErr
+}
+
+// compactionSuffix is added to the map file and data segment paths to name the files a
+// compaction writes, segments after the first are numbered after the new data file so
+// data.compact, data.compact.000001 and so on
+const compactionSuffix = ".compact"
+
+// compactedSuffix is what the new map file is renamed to once every new file is on disk,
+// its name is what marks the compaction as done
+const compactedSuffix = ".compacted"
+
+// installCompaction moves the files of a compaction that is done into place, deleting the
+// old segments it replaced and the hint. Each step can be repeated, so after a crash part
+// way through Open runs it again
+func installCompaction(mapFilePath string, dataFilePath string) error {
+	newSegments, err := listCompactionSegments(dataFilePath)
+	if err != nil {
+		return err
+	}
+	// the old segments go before any new one is renamed, once some have been the last new
+	// segment still left is the highest one
+	if len(newSegments) > 0 {
+		last := newSegments[len(newSegments)-1]
+		oldSegments, err := listSegments(dataFilePath)
+		if err != nil {
+			return err
+		}
+		for _, id := range oldSegments {
+			if id > last {
+				if err := os.Remove(SegmentPath(dataFilePath, id)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, id := range newSegments {
+		if err := os.Rename(SegmentPath(dataFilePath+compactionSuffix, id), SegmentPath(dataFilePath, id)); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(HintPath(mapFilePath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(mapFilePath+compactedSuffix, mapFilePath); err != nil {
+		return err
+	}
+	return syncDirectory(mapFilePath)
+}
+
+// listCompactionSegments returns the ids of the new data segments written by a compaction
+// that have not been moved into place yet, in order
+func listCompactionSegments(dataFilePath string) ([]uint32, error) {
+	tempPath := dataFilePath + compactionSuffix
+	ids, err := listSegments(tempPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(tempPath); err == nil {
+		ids = append(ids, 0)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// removeCompactionFiles deletes the files of a compaction that did not finish
+func removeCompactionFiles(mapFilePath string, dataFilePath string) error {
+	ids, err := listCompactionSegments(dataFilePath)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := os.Remove(SegmentPath(dataFilePath+compactionSuffix, id)); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(mapFilePath + compactionSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// finishCompaction is run as the files are opened. It completes a compaction that was
+// interrupted once it was done, or throws away the files of one interrupted before
+func finishCompaction(mapFilePath string, dataFilePath string) error {
+	if _, err := os.Stat(mapFilePath + compactedSuffix); err == nil {
+		log.Printf("Finishing compaction interrupted by a crash\n")
+		return installCompaction(mapFilePath, dataFilePath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return removeCompactionFiles(mapFilePath, dataFilePath)
+}
+
+// copySegments copies the segment map so it can be read while the data processor adds to it
+func (eng *StorageEngine) copySegments() map[uint32]EngineFile {
+	eng.filesLock.RLock()
+	defer eng.filesLock.RUnlock()
+	segments := make(map[uint32]EngineFile, len(eng.segments))
+	for id, segment := range eng.segments {
+		segments[id] = segment
+	}
+	return segments
+}
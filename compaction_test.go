@@ -0,0 +1,172 @@
+package toydb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func fileSize(t *testing.T, file EngineFile) int64 {
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	return info.Size()
+}
+
+func pathSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	return info.Size()
+}
+
+func Test_StorageEngine_Compact_keepsOnlyLiveValues(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("overwritten", "first")
+	storageEngine.Set("overwritten", "second")
+	storageEngine.Set("deleted", "gone")
+	storageEngine.Delete("deleted")
+	storageEngine.Set("kept", "value")
+
+	err := storageEngine.Compact()
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, pathSize(t, filepath.Join(dir, "data")), int64(fileHeaderLength+len(encodeDataEntry([]byte("overwritten"), []byte("second")))+len(encodeDataEntry([]byte("kept"), []byte("value")))))
+	shouldEqual(t, pathSize(t, filepath.Join(dir, "map")), int64(fileHeaderLength+2*mapRecordLength))
+	overwritten, _ := storageEngine.Get("overwritten")
+	shouldEqual(t, overwritten, []byte("second"))
+	_, err = storageEngine.Get("deleted")
+	shouldEqual(t, err, ErrNotFound)
+
+	shouldEqual(t, storageEngine.Set("after", "compaction"), nil)
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	kept, _ := storageEngine.Get("kept")
+	shouldEqual(t, kept, []byte("value"))
+	after, _ := storageEngine.Get("after")
+	shouldEqual(t, after, []byte("compaction"))
+	// the map and data files and the hint saved on shutdown
+	entries, _ := os.ReadDir(dir)
+	shouldEqual(t, len(entries), 3)
+}
+
+func Test_StorageEngine_Compact_needsFilePaths(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine, err := NewStorageEngine(openTestFile(t, filepath.Join(dir, "map")), openTestFile(t, filepath.Join(dir, "data")))
+	shouldEqual(t, err, nil)
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Compact(), ErrMissingFilePath)
+}
+
+func Test_Open_finishesCompactionInterruptedOnceDone(t *testing.T) {
+	dir := t.TempDir()
+	old := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 10})
+	old.Set("key", "old")
+	old.Set("other", "old")
+	old.Shutdown()
+	// the files the compaction wrote, which were on disk before it was interrupted
+	compactedDir := t.TempDir()
+	compacted := openTestEngine(t, compactedDir)
+	compacted.Set("key", "compacted")
+	compacted.Shutdown()
+	os.Rename(filepath.Join(compactedDir, "map"), filepath.Join(dir, "map.compacted"))
+	os.Rename(filepath.Join(compactedDir, "data"), filepath.Join(dir, "data.compact"))
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	value, _ := storageEngine.Get("key")
+	shouldEqual(t, value, []byte("compacted"))
+	_, err := storageEngine.Get("other")
+	shouldEqual(t, err, ErrNotFound)
+	entries, _ := os.ReadDir(dir)
+	shouldEqual(t, len(entries), 2)
+}
+
+func Test_Open_finishesCompactionInterruptedPartWayThroughInstall(t *testing.T) {
+	dir := t.TempDir()
+	old := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 30})
+	for i := 0; i < 4; i++ {
+		old.Set(fmt.Sprintf("key%d", i), "old")
+	}
+	old.Shutdown()
+	compactedDir := t.TempDir()
+	compacted := openTestEngineWithConfig(t, compactedDir, StorageEngineConfig{SegmentSize: 30})
+	compacted.Set("key0", "compacted")
+	compacted.Set("key1", "compacted")
+	compacted.Shutdown()
+	// the first new segment had already been renamed over the old one
+	os.Rename(filepath.Join(compactedDir, "map"), filepath.Join(dir, "map.compacted"))
+	os.Rename(filepath.Join(compactedDir, "data"), filepath.Join(dir, "data"))
+	os.Rename(filepath.Join(compactedDir, "data.000001"), filepath.Join(dir, "data.compact.000001"))
+
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 30})
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.dataSegment, uint32(1))
+	for i := 0; i < 4; i++ {
+		value, _ := storageEngine.Get(fmt.Sprintf("key%d", i))
+		if i < 2 {
+			shouldEqual(t, value, []byte("compacted"))
+		} else {
+			shouldEqual(t, value == nil, true)
+		}
+	}
+	ids, _ := listSegments(filepath.Join(dir, "data"))
+	shouldEqual(t, ids, []uint32{1})
+}
+
+func Test_Open_throwsAwayCompactionInterruptedBeforeDone(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("key", "value")
+	storageEngine.Shutdown()
+	for _, name := range []string{"map.compact", "data.compact", "data.compact.000001"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0644)
+	}
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	value, _ := storageEngine.Get("key")
+	shouldEqual(t, value, []byte("value"))
+	entries, _ := os.ReadDir(dir)
+	shouldEqual(t, len(entries), 3)
+}
+
+func Test_StorageEngine_Compact_keepsWritesMadeWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	for i := 0; i < 100; i++ {
+		storageEngine.Set(fmt.Sprintf("key%d", i), "old")
+	}
+
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go (func(w int) {
+			defer writers.Done()
+			for i := w; i < 100; i += 4 {
+				storageEngine.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("new%d", i))
+				storageEngine.Get(fmt.Sprintf("key%d", i))
+			}
+		})(w)
+	}
+	err := storageEngine.Compact()
+	writers.Wait()
+
+	shouldEqual(t, err, nil)
+	for i := 0; i < 100; i++ {
+		value, _ := storageEngine.Get(fmt.Sprintf("key%d", i))
+		shouldEqual(t, string(value), fmt.Sprintf("new%d", i))
+	}
+}
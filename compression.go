@@ -0,0 +1,119 @@
+package toydb
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Compression picks how values are compressed in the data file. Each entry records what
+// its value was compressed with, so changing it does not affect values already written
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	// CompressionFlate is DEFLATE at its fastest level
+	CompressionFlate
+)
+
+var ErrUnknownCompression = errors.New("toydb: unknown compression")
+
+func (c Compression) valid() bool {
+	return c <= CompressionFlate
+}
+
+// flate writers and readers hold large buffers so they are reused
+var flateWriters = sync.Pool{New: func() interface{} {
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return writer
+}}
+
+var flateReaders = sync.Pool{New: func() interface{} {
+	return flate.NewReader(nil)
+}}
+
+func compressValue(codec Compression, value []byte) []byte {
+	if codec == CompressionNone {
+		return value
+	}
+	var buffer bytes.Buffer
+	writer := flateWriters.Get().(*flate.Writer)
+	writer.Reset(&buffer)
+	writer.Write(value)
+	writer.Close()
+	flateWriters.Put(writer)
+	return buffer.Bytes()
+}
+
+func decompressValue(codec Compression, value []byte) ([]byte, error) {
+	if codec == CompressionNone {
+		return value, nil
+	}
+	reader := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(reader)
+	if err := reader.(flate.Resetter).Reset(bytes.NewReader(value), nil); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// CompressionStats counts the values handed to Set, Put and Apply since the engine was
+// opened
+type CompressionStats struct {
+	Values int64
+	// CompressedValues counts the values that were stored compressed
+	CompressedValues int64
+	// RawBytes is the size of the values as they were given, StoredBytes their size in the
+	// data file
+	RawBytes    int64
+	StoredBytes int64
+}
+
+// Ratio is RawBytes over StoredBytes, so 2 means values take half the space they would
+// uncompressed. It is 1 before anything has been written
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+func (eng *StorageEngine) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Values:           atomic.LoadInt64(&eng.compressionStats.Values),
+		CompressedValues: atomic.LoadInt64(&eng.compressionStats.CompressedValues),
+		RawBytes:         atomic.LoadInt64(&eng.compressionStats.RawBytes),
+		StoredBytes:      atomic.LoadInt64(&eng.compressionStats.StoredBytes),
+	}
+}
+
+// encodeEntry is encodeDataEntry with the value compressed when the engine is set to
+// compress and it comes out smaller, and encrypted when it has a KeyProvider. It runs on
+// the caller's goroutine, not the data processor's, so values from different callers are
+// encoded in parallel
+func (eng *StorageEngine) encodeEntry(key []byte, value []byte) ([]byte, error) {
+	return eng.encodeFlaggedEntry(key, value, 0)
+}
+
+// encodeFlaggedEntry is encodeEntry for an entry that carries flags besides its codec, so
+// far only entryKeyHashed
+func (eng *StorageEngine) encodeFlaggedEntry(key []byte, value []byte, flags entryFlags) ([]byte, error) {
+	stored, codec := value, CompressionNone
+	if eng.compression != CompressionNone {
+		if compressed := compressValue(eng.compression, value); len(compressed) < len(value) {
+			stored, codec = compressed, eng.compression
+			atomic.AddInt64(&eng.compressionStats.CompressedValues, 1)
+		}
+	}
+	atomic.AddInt64(&eng.compressionStats.Values, 1)
+	atomic.AddInt64(&eng.compressionStats.RawBytes, int64(len(value)))
+	atomic.AddInt64(&eng.compressionStats.StoredBytes, int64(len(stored)))
+	flags |= entryFlags(codec)
+	if eng.cipher != nil {
+		return eng.cipher.seal(key, stored, flags)
+	}
+	return encodeStoredEntry(key, stored, flags), nil
+}
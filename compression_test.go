@@ -0,0 +1,93 @@
+package toydb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_StorageEngine_Set_compressesValues(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{Compression: CompressionFlate})
+	defer storageEngine.Shutdown()
+	value := strings.Repeat(`{"name": "toydb", "tags": ["a", "b"]}`, 100)
+
+	shouldEqual(t, storageEngine.Set("key", value), nil)
+	stored, err := storageEngine.Get("key")
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, stored, []byte(value))
+	if storageEngine.dataFileLength >= int64(len(value)) {
+		t.Errorf("data file is %d bytes, the value was not compressed", storageEngine.dataFileLength)
+	}
+	stats := storageEngine.CompressionStats()
+	shouldEqual(t, stats.Values, int64(1))
+	shouldEqual(t, stats.CompressedValues, int64(1))
+	shouldEqual(t, stats.RawBytes, int64(len(value)))
+	shouldEqual(t, stats.Ratio() > 10, true)
+}
+
+func Test_StorageEngine_Set_storesIncompressibleValuesAsTheyAre(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{Compression: CompressionFlate})
+	defer storageEngine.Shutdown()
+	value := make([]byte, 200)
+	rand.Read(value)
+
+	shouldEqual(t, storageEngine.Put([]byte("key"), value), nil)
+	stored, _ := storageEngine.GetBytes([]byte("key"))
+
+	shouldEqual(t, stored, value)
+	stats := storageEngine.CompressionStats()
+	shouldEqual(t, stats.CompressedValues, int64(0))
+	shouldEqual(t, stats.Ratio(), 1.0)
+}
+
+func Test_StorageEngine_readsMixedCompressedAndPlainValues(t *testing.T) {
+	dir := t.TempDir()
+	plain := strings.Repeat("plain ", 50)
+	compressed := strings.Repeat("compressed ", 50)
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{Compression: CompressionNone})
+	storageEngine.Set("plain", plain)
+	storageEngine.Shutdown()
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{Compression: CompressionFlate})
+	var batch WriteBatch
+	batch.Set("compressed", compressed)
+	storageEngine.Apply(&batch)
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{Compression: CompressionNone})
+	defer storageEngine.Shutdown()
+
+	value, _ := storageEngine.Get("plain")
+	shouldEqual(t, value, []byte(plain))
+	value, _ = storageEngine.Get("compressed")
+	shouldEqual(t, value, []byte(compressed))
+	shouldEqual(t, collectKeys(t, storageEngine.Keys()), []string{"compressed", "plain"})
+}
+
+func Test_NewStorageEngineWithConfig_returnsErrUnknownCompression(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Open(StorageEngineConfig{
+		MapFilePath:  filepath.Join(dir, "map"),
+		DataFilePath: filepath.Join(dir, "data"),
+		Compression:  CompressionFlate + 1,
+	})
+
+	shouldEqual(t, err, ErrUnknownCompression)
+}
+
+func Test_StorageEngine_Put_returnsErrKeyTooLarge(t *testing.T) {
+	storageEngine := newTestEngine(t)
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Put(make([]byte, maxKeyLength+1), []byte("value")), ErrKeyTooLarge)
+}
+
+func Test_decodeDataEntry_returnsCorruptionErrorWhenValueDoesNotDecompress(t *testing.T) {
+	entry := encodeStoredEntry([]byte("key"), bytes.Repeat([]byte{0xFF}, 10), entryFlags(CompressionFlate))
+
+	_, _, err := decodeDataEntry(entry, 40, nil)
+
+	shouldEqual(t, err, &CorruptionError{"data", 40, "value does not decompress"})
+}
@@ -0,0 +1,145 @@
+package toydb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync"
+)
+
+// KeyProvider hands out the AES keys values are encrypted with. Every encrypted entry
+// records the id of its key, so an id must always return the same key, and old keys have
+// to stay available until RotateKeys has moved every value off them
+type KeyProvider interface {
+	// CurrentKey returns the 16, 24 or 32 byte key new values are encrypted with, and its id
+	CurrentKey() (id uint32, key []byte, err error)
+	Key(id uint32) ([]byte, error)
+}
+
+var ErrUnknownKey = errors.New("toydb: unknown encryption key")
+
+// ErrNoKeyProvider is returned when reading an encrypted value from an engine opened
+// without a KeyProvider
+var ErrNoKeyProvider = errors.New("toydb: value is encrypted and no KeyProvider is set")
+
+// KeyRing is a KeyProvider that holds its keys in memory
+type KeyRing struct {
+	// Current is the id of the key new values are encrypted with
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+func (r *KeyRing) CurrentKey() (uint32, []byte, error) {
+	key, err := r.Key(r.Current)
+	return r.Current, key, err
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	key, ok := r.Keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// an encrypted entry has the encrypted flag set and a key length of zero in its header,
+// then a 4 byte uint32 key id, a 12 byte nonce and the AES-GCM sealed 4 byte uint32 key
+// length, key and value. The header and key id are authenticated along with them
+const sealedHeaderLength = 4 + 12
+
+// entryCipher seals and opens entries with keys from a KeyProvider. A nil entryCipher
+// can open nothing
+type entryCipher struct {
+	keys  KeyProvider
+	mutex sync.Mutex
+	// built once per key id, keys never change under an id
+	aeads map[uint32]cipher.AEAD
+}
+
+func newEntryCipher(keys KeyProvider) *entryCipher {
+	if keys == nil {
+		return nil
+	}
+	return &entryCipher{keys: keys, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// aead returns the AEAD for a key id, key is fetched from the KeyProvider when it is nil
+func (c *entryCipher) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+	if key == nil {
+		var err error
+		if key, err = c.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// seal encodes an entry like encodeStoredEntry, encrypted with the current key
+func (c *entryCipher) seal(key []byte, value []byte, flags entryFlags) ([]byte, error) {
+	id, secret, err := c.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(id, secret)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 4+len(key)+len(value))
+	binary.BigEndian.PutUint32(plaintext[0:4], uint32(len(key)))
+	copy(plaintext[4:], key)
+	copy(plaintext[4+len(key):], value)
+
+	sealedStart := entryHeaderLength + sealedHeaderLength
+	entry := make([]byte, sealedStart, sealedStart+len(plaintext)+aead.Overhead())
+	entry[4] = byte(entryEncrypted | flags)
+	binary.BigEndian.PutUint32(entry[8:12], id)
+	nonce := entry[12:sealedStart]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	entry = aead.Seal(entry, nonce, plaintext, entry[4:12])
+	binary.BigEndian.PutUint32(entry[0:4], crc32.Checksum(entry[4:], crcTable))
+	return entry, nil
+}
+
+// open decrypts the key and value of an entry read from offset in the data file, its
+// checksum has already been checked by splitDataEntry
+func (c *entryCipher) open(entry []byte, offset int64) (key []byte, value []byte, err error) {
+	if c == nil {
+		return nil, nil, ErrNoKeyProvider
+	}
+	sealedStart := entryHeaderLength + sealedHeaderLength
+	if len(entry) < sealedStart {
+		return nil, nil, &CorruptionError{"data", offset, "entry shorter than its header"}
+	}
+	aead, err := c.aead(binary.BigEndian.Uint32(entry[8:12]), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := aead.Open(nil, entry[12:sealedStart], entry[sealedStart:], entry[4:12])
+	if err != nil {
+		return nil, nil, &CorruptionError{"data", offset, "value failed authentication"}
+	}
+	keyLength := int64(binary.BigEndian.Uint32(plaintext[0:4]))
+	if keyLength > int64(len(plaintext)-4) {
+		return nil, nil, &CorruptionError{"data", offset, "key longer than entry"}
+	}
+	return plaintext[4 : 4+keyLength], plaintext[4+keyLength:], nil
+}
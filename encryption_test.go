@@ -0,0 +1,146 @@
+package toydb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyRing(current uint32, ids ...uint32) *KeyRing {
+	keys := make(map[uint32][]byte)
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+	}
+	return &KeyRing{Current: current, Keys: keys}
+}
+
+func Test_StorageEngine_Set_encryptsKeysAndValues(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1)})
+	shouldEqual(t, storageEngine.Set("secret-key", "secret-value"), nil)
+	var batch WriteBatch
+	batch.Set("batch-key", "batch-value")
+	shouldEqual(t, storageEngine.Apply(&batch), nil)
+
+	value, err := storageEngine.Get("secret-key")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("secret-value"))
+	value, _ = storageEngine.Get("batch-key")
+	shouldEqual(t, value, []byte("batch-value"))
+	shouldEqual(t, collectKeys(t, storageEngine.Keys()), []string{"batch-key", "secret-key"})
+	storageEngine.Shutdown()
+
+	data, _ := os.ReadFile(filepath.Join(dir, "data"))
+	for _, plaintext := range []string{"secret", "batch"} {
+		if bytes.Contains(data, []byte(plaintext)) {
+			t.Errorf("data file contains %q", plaintext)
+		}
+	}
+}
+
+func Test_StorageEngine_Get_encryptedWithCompression(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1), Compression: CompressionFlate})
+	defer storageEngine.Shutdown()
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	storageEngine.Put([]byte("key"), value)
+	stored, err := storageEngine.GetBytes([]byte("key"))
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, stored, value)
+	shouldEqual(t, storageEngine.CompressionStats().CompressedValues, int64(1))
+}
+
+func Test_StorageEngine_Get_returnsErrNoKeyProviderForEncryptedValue(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1)})
+	storageEngine.Set("key", "value")
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	_, err := storageEngine.Get("key")
+
+	shouldEqual(t, err, ErrNoKeyProvider)
+}
+
+func Test_StorageEngine_Get_returnsCorruptionErrorForWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1)})
+	storageEngine.Set("key", "value")
+	storageEngine.Shutdown()
+
+	wrongKeys := &KeyRing{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{9}, 32)}}
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: wrongKeys})
+	defer storageEngine.Shutdown()
+	_, err := storageEngine.Get("key")
+
+	shouldEqual(t, errors.Is(err, ErrCorrupted), true)
+	shouldEqual(t, err, &CorruptionError{"data", fileHeaderLength, "value failed authentication"})
+}
+
+func Test_StorageEngine_Set_returnsKeyProviderError(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{KeyProvider: testKeyRing(2, 1)})
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Set("key", "value"), ErrUnknownKey)
+}
+
+func Test_RotateKeys_reencryptsEveryValueWithCurrentKey(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("plain", "value-plain")
+	storageEngine.Shutdown()
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1), SegmentSize: 40})
+	for i := 0; i < 4; i++ {
+		storageEngine.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	storageEngine.Delete("key0")
+	storageEngine.Shutdown()
+
+	shouldEqual(t, RotateKeys(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data"), KeyProvider: testKeyRing(2, 1, 2), SegmentSize: 40}), nil)
+
+	ids, _ := listCompactionSegments(filepath.Join(dir, "data"))
+	shouldEqual(t, len(ids), 0)
+	_, err := os.Stat(filepath.Join(dir, "map.compacted"))
+	shouldEqual(t, os.IsNotExist(err), true)
+	// only the new key is needed now
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(2, 2), SegmentSize: 40})
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	value, err := storageEngine.Get("plain")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("value-plain"))
+	_, err = storageEngine.Get("key0")
+	shouldEqual(t, err, ErrNotFound)
+	for i := 1; i < 4; i++ {
+		value, _ := storageEngine.Get(fmt.Sprintf("key%d", i))
+		shouldEqual(t, value, []byte(fmt.Sprintf("value%d", i)))
+	}
+}
+
+func Test_RotateKeys_discardsFilesFromInterruptedCopy(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1)})
+	storageEngine.Set("key", "value")
+	storageEngine.Shutdown()
+	os.WriteFile(filepath.Join(dir, "map.compact"), []byte("partial"), 0644)
+	os.WriteFile(filepath.Join(dir, "data.compact"), []byte("partial"), 0644)
+
+	shouldEqual(t, RotateKeys(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data"), KeyProvider: testKeyRing(2, 1, 2)}), nil)
+
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(2, 2)})
+	defer storageEngine.Shutdown()
+	value, _ := storageEngine.Get("key")
+	shouldEqual(t, value, []byte("value"))
+}
+
+func Test_RotateKeys_needsKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+
+	shouldEqual(t, RotateKeys(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")}), ErrNoKeyProvider)
+}
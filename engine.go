@@ -1,12 +1,19 @@
 package toydb
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,57 +23,269 @@ const (
 
 type shutdown struct{}
 
+// a map record with this length marks its key as deleted, it has no data in the data file
+const tombstoneLength = -1
+
 type dataInfo struct {
-	offset int64
-	length int64
+	// the data file segment the value is in
+	segment uint32
+	offset  int64
+	length  int64
+	// when the key expires in unix nanoseconds, zero if it never does
+	expiry int64
+}
+
+// expired reports whether the key had expired by now, also in unix nanoseconds
+func (d dataInfo) expired(now int64) bool {
+	return d.expiry != 0 && d.expiry <= now
+}
+
+func (d dataInfo) isTombstone() bool {
+	return d.length == tombstoneLength
+}
+
+// a map record with this length starts a batch, its offset is the number of records in
+// the batch that follow it
+const batchHeaderLength = -2
+
+func (d dataInfo) isBatchHeader() bool {
+	return d.length == batchHeaderLength
 }
 
 func (d dataInfo) toByteSlice() []byte {
-	buffer := make([]byte, 16)
-	binary.BigEndian.PutUint64(buffer[0:8], uint64(d.offset))
-	binary.BigEndian.PutUint64(buffer[8:16], uint64(d.length))
+	buffer := make([]byte, 28)
+	binary.BigEndian.PutUint32(buffer[0:4], d.segment)
+	binary.BigEndian.PutUint64(buffer[4:12], uint64(d.offset))
+	binary.BigEndian.PutUint64(buffer[12:20], uint64(d.length))
+	binary.BigEndian.PutUint64(buffer[20:28], uint64(d.expiry))
 	return buffer
 }
 
-//32 byte key hash, 8 byte uint64 for offset, 8 byte uint64 for length
-func parseOffsetMap(file io.ReaderAt) map[[32]byte]dataInfo {
-	const recordLength = 48
-	var offset int64 = 0
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// each value in the data file is stored next to its original key
+// 4 byte uint32 CRC32C of the rest of the entry, 4 byte uint32 with the entryFlags in the
+// top byte and the key length in the rest, the key bytes, then the value bytes. Entries
+// from before the flags were added have a zero top byte so they read as uncompressed.
+// The key and value of an encrypted entry are sealed, see sealedHeaderLength
+const entryHeaderLength = 8
+
+// keys are limited to what fits next to the flags
+const maxKeyLength = 1<<24 - 1
+
+// entryFlags hold the Compression of the value in the low bits, entryKeyHashed and
+// entryEncrypted
+type entryFlags byte
+
+const (
+	// the entry holds the sha256 of its key in place of the key, Migrate writes these for
+	// values from before keys were stored
+	entryKeyHashed entryFlags = 0x40
+	entryEncrypted entryFlags = 0x80
+)
+
+func (f entryFlags) codec() Compression {
+	return Compression(f &^ (entryKeyHashed | entryEncrypted))
+}
+
+func (f entryFlags) keyHashed() bool {
+	return f&entryKeyHashed != 0
+}
+
+func (f entryFlags) encrypted() bool {
+	return f&entryEncrypted != 0
+}
+
+func encodeDataEntry(key []byte, value []byte) []byte {
+	return encodeStoredEntry(key, value, entryFlags(CompressionNone))
+}
+
+// encodeStoredEntry writes value as it is, flags hold the codec it was compressed with
+func encodeStoredEntry(key []byte, value []byte, flags entryFlags) []byte {
+	entry := make([]byte, entryHeaderLength+len(key)+len(value))
+	binary.BigEndian.PutUint32(entry[4:8], uint32(flags)<<24|uint32(len(key)))
+	copy(entry[entryHeaderLength:], key)
+	copy(entry[entryHeaderLength+len(key):], value)
+	binary.BigEndian.PutUint32(entry[0:4], crc32.Checksum(entry[4:], crcTable))
+	return entry
+}
+
+// splitDataEntry checks the entry read from offset in the data file against its checksum
+// and returns the value as it is stored, along with its flags. The key and value of an
+// encrypted entry are left sealed
+func splitDataEntry(entry []byte, offset int64) (key []byte, value []byte, flags entryFlags, err error) {
+	if len(entry) < entryHeaderLength {
+		return nil, nil, 0, &CorruptionError{"data", offset, "entry shorter than its header"}
+	}
+	if crc32.Checksum(entry[4:], crcTable) != binary.BigEndian.Uint32(entry[0:4]) {
+		return nil, nil, 0, &CorruptionError{"data", offset, "checksum mismatch"}
+	}
+	flags = entryFlags(entry[4])
+	if !flags.codec().valid() {
+		return nil, nil, 0, &CorruptionError{"data", offset, "unknown compression"}
+	}
+	keyLength := int64(binary.BigEndian.Uint32(entry[4:8]) & maxKeyLength)
+	if keyLength > int64(len(entry)-entryHeaderLength) {
+		return nil, nil, 0, &CorruptionError{"data", offset, "key longer than entry"}
+	}
+	keyEnd := entryHeaderLength + keyLength
+	return entry[entryHeaderLength:keyEnd], entry[keyEnd:], flags, nil
+}
+
+// decodeDataEntry is splitDataEntry that also decrypts and decompresses the value, c can
+// be nil when the engine has no KeyProvider
+func decodeDataEntry(entry []byte, offset int64, c *entryCipher) (key []byte, value []byte, err error) {
+	key, value, flags, err := splitDataEntry(entry, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags.encrypted() {
+		if key, value, err = c.open(entry, offset); err != nil {
+			return nil, nil, err
+		}
+	}
+	if value, err = decompressValue(flags.codec(), value); err != nil {
+		return nil, nil, &CorruptionError{"data", offset, "value does not decompress"}
+	}
+	return key, value, nil
+}
+
+// 32 byte key hash, 4 byte uint32 for segment, 8 byte uint64 for offset, 8 byte uint64 for
+// length, 8 byte uint64 for expiry, 4 byte uint32 CRC32C of the first 60 bytes. A length of
+// tombstoneLength (all bits set) removes the key
+const mapRecordLength = 64
+
+func encodeMapRecord(key []byte, info dataInfo) []byte {
+	record := make([]byte, mapRecordLength)
+	copy(record[0:32], key)
+	copy(record[32:60], info.toByteSlice())
+	binary.BigEndian.PutUint32(record[60:64], crc32.Checksum(record[0:60], crcTable))
+	return record
+}
+
+// parseOffsetMap reads a whole map file, which has to be in the current format
+func parseOffsetMap(file io.ReaderAt) (map[[32]byte]dataInfo, error) {
 	offsetMap := make(map[[32]byte]dataInfo)
-	var hashBuffer [recordLength]byte
-	var dataOffsetIntBytes [8]byte
-	var dataLengthIntBytes [8]byte
-	readBytes := recordLength
-	for readBytes == recordLength {
-		var err error
-		readBytes, err = file.ReadAt(hashBuffer[:], offset)
-		if readBytes == recordLength {
-			if err != io.EOF && err != nil {
-				log.Fatal("Failed to parse header")
+	if _, err := readFileHeader(file, "map"); err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return offsetMap, err
+	}
+	_, err := forEachMapRecord(file, fileHeaderLength, func(records []mapRecord) bool {
+		for _, record := range records {
+			if record.info.isTombstone() {
+				delete(offsetMap, record.keyHash)
+			} else {
+				offsetMap[record.keyHash] = record.info
 			}
-			var keyHash [32]byte
-			copy(keyHash[:], hashBuffer[:])
-			copy(dataOffsetIntBytes[:], hashBuffer[32:40])
-			copy(dataLengthIntBytes[:], hashBuffer[40:48])
-			dataOffsetInt := int64(binary.BigEndian.Uint64(dataOffsetIntBytes[:]))
-			dataLengthInt := int64(binary.BigEndian.Uint64(dataLengthIntBytes[:]))
-			offsetMap[keyHash] = dataInfo{offset: dataOffsetInt, length: dataLengthInt}
-			offset += int64(readBytes)
 		}
+		return true
+	})
+	return offsetMap, err
+}
+
+// mapRecord is a decoded map record and where it sits in the map file
+type mapRecord struct {
+	offset  int64
+	keyHash [32]byte
+	info    dataInfo
+}
+
+// mapReadChunk is how much of the map file is read at once when replaying it, a whole
+// number of records so a chunk never ends part way through one
+const mapReadChunk = 4096 * mapRecordLength
+
+// mapRecordReader reads the map file a chunk at a time rather than making a ReadAt call
+// for every record
+type mapRecordReader struct {
+	file   io.ReaderAt
+	buffer []byte
+	// where buffer starts in the file and how much of it was filled
+	bufferOffset int64
+	filled       int
+}
+
+func newMapRecordReader(file io.ReaderAt) *mapRecordReader {
+	return &mapRecordReader{file: file, buffer: make([]byte, mapReadChunk)}
+}
+
+// read returns false when there is no whole record at offset
+func (r *mapRecordReader) read(offset int64) (mapRecord, bool, error) {
+	if offset < r.bufferOffset || offset+mapRecordLength > r.bufferOffset+int64(r.filled) {
+		readBytes, err := r.file.ReadAt(r.buffer, offset)
+		if err != io.EOF && err != nil {
+			return mapRecord{}, false, err
+		}
+		r.bufferOffset = offset
+		r.filled = readBytes
+		if readBytes < mapRecordLength {
+			return mapRecord{}, false, nil
+		}
+	}
+	start := offset - r.bufferOffset
+	return decodeMapRecord(r.buffer[start:start+mapRecordLength], offset)
+}
+
+func decodeMapRecord(buffer []byte, offset int64) (mapRecord, bool, error) {
+	if crc32.Checksum(buffer[0:60], crcTable) != binary.BigEndian.Uint32(buffer[60:64]) {
+		return mapRecord{}, false, &CorruptionError{"map", offset, "checksum mismatch"}
+	}
+	record := mapRecord{offset: offset}
+	copy(record.keyHash[:], buffer[0:32])
+	record.info.segment = binary.BigEndian.Uint32(buffer[32:36])
+	record.info.offset = int64(binary.BigEndian.Uint64(buffer[36:44]))
+	record.info.length = int64(binary.BigEndian.Uint64(buffer[44:52]))
+	record.info.expiry = int64(binary.BigEndian.Uint64(buffer[52:60]))
+	return record, true, nil
+}
+
+// forEachMapRecord calls apply with every whole record from start onwards and returns the
+// offset after the last ones applied. The records of a batch are passed in one call once
+// they have all been read, a single record on its own. It stops early when apply returns
+// false, at a batch cut short by the end of the file, or at the first record that fails
+// its checksum, returning where that record's batch starts. The records slice is reused
+// between calls so apply must not keep it
+func forEachMapRecord(file io.ReaderAt, start int64, apply func(records []mapRecord) bool) (int64, error) {
+	reader := newMapRecordReader(file)
+	records := make([]mapRecord, 0, 1)
+	offset := start
+	for {
+		record, ok, err := reader.read(offset)
+		if !ok {
+			return offset, err
+		}
+		end := offset + mapRecordLength
+		records = append(records[:0], record)
+		if record.info.isBatchHeader() {
+			records = records[:0]
+			for i := int64(0); i < record.info.offset; i++ {
+				batchRecord, ok, err := reader.read(end)
+				if !ok {
+					return offset, err
+				}
+				records = append(records, batchRecord)
+				end += mapRecordLength
+			}
+		}
+		if !apply(records) {
+			return offset, nil
+		}
+		offset = end
 	}
-	return offsetMap
 }
 
 type dataToWrite struct {
 	key             []byte
 	value           []byte
-	responseChannel chan int
+	responseChannel chan error
+	expiry          int64
 }
 
 type dataToMap struct {
 	key             []byte
 	dataInfo        dataInfo
-	responseChannel chan int
+	responseChannel chan error
 }
 
 func writeData(requestId string, file io.Writer, data []byte) (int, error) {
@@ -88,38 +307,198 @@ type EngineFile interface {
 	io.Writer
 	io.Closer
 	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
 }
 
+// Store is the key value interface shared by the embedded StorageEngine and the
+// remote client in the client package, so callers can switch between the two
+type Store interface {
+	// Get returns ErrNotFound when the key is not set
+	Get(key string) ([]byte, error)
+	Set(key string, value string) error
+	Delete(key string) error
+}
+
+var _ Store = (*StorageEngine)(nil)
+
 type StorageEngineConfig struct {
 	MapFilePath  string
 	DataFilePath string
+	// SyncMode picks when writes are flushed to disk, Set returns once they have been
+	SyncMode SyncMode
+	// SyncInterval is how often SyncGroupCommit flushes, defaults to 10ms
+	SyncInterval time.Duration
+	// SegmentSize caps the size of each data file segment, once a write would take the
+	// current segment past it a new one is started next to DataFilePath. Zero keeps every
+	// value in one data file
+	SegmentSize int64
+	// SweepInterval is how often keys set with a ttl are checked and deleted once they have
+	// expired, defaults to a second
+	SweepInterval time.Duration
+	// Compression is what values are compressed with before they are written, values
+	// that do not get any smaller are stored as they are. Values already written stay
+	// readable whatever it is set to
+	Compression Compression
+	// KeyProvider turns on AES-GCM encryption of every key and value written to the data
+	// files. Get checks and decrypts each one, so the provider has to hold every key
+	// still in use
+	KeyProvider KeyProvider
+	// MmapReads reads the data segments through memory mappings, so Get copies a value
+	// straight out of memory rather than making a read syscall, and View can hand out the
+	// value without copying it at all. It is ignored on platforms without mmap
+	MmapReads bool
 }
 
 type StorageEngine struct {
-	dataChannel             chan dataToWrite
-	mapChannel              chan dataToMap
-	offsetMap               map[[32]byte]dataInfo
-	mapFile                 EngineFile
-	mapFileLength           int64
-	dataFile                EngineFile
-	dataFileLength          int64
+	dataChannel      chan dataToWrite
+	mapChannel       chan dataToMap
+	dataBatchChannel chan batchToWrite
+	mapBatchChannel  chan batchToMap
+	sweepChannel     chan []indexEntry
+	offsetMap        *offsetIndex
+	mapFile          EngineFile
+	mapFileLength    int64
+	// the segment being written to, its id and length
+	dataFile       EngineFile
+	dataSegment    uint32
+	dataFileLength int64
+	// every data segment by id including the one being written to, guarded by filesLock
+	segments    map[uint32]EngineFile
+	nextSegment uint32
+	segmentSize int64
+	// opens a segment by id, nil when the engine has no DataFilePath to name segments after
+	openSegment func(id uint32) (EngineFile, error)
+	// where the offset map is saved on Shutdown, empty when the engine has no MapFilePath
+	hintPath string
+	// where compaction puts the files, empty when the engine was not given them
+	mapFilePath             string
+	dataFilePath            string
 	shutdownTriggerChannel  chan struct{}
 	shutdownResponseChannel chan int
+	dataPauseChannel        chan chan struct{}
+	mapPauseChannel         chan chan struct{}
+	// held for reading by Get and for writing while compaction swaps the files and the
+	// offset map, so Get never pairs new offsets with an old file
+	filesLock sync.RWMutex
+	// set under filesLock once Shutdown has stopped the processors, before the files close
+	closed          bool
+	shutdownOnce    sync.Once
+	compactionMutex sync.Mutex
+	recovery        RecoveryReport
+	syncMode        SyncMode
+	syncInterval    time.Duration
+	sweepInterval   time.Duration
+	compression     Compression
+	// nil without a KeyProvider
+	cipher    *entryCipher
+	mmapReads bool
+	// updated with atomic adds by the goroutines calling Set and Apply
+	compressionStats CompressionStats
+	// responses held back by SyncGroupCommit until the next sync, only touched by the map processor
+	pendingSyncs []chan error
+	// set once the files could be left in a state later writes must not build on, every
+	// write from then on is refused with it
+	writesStopped     error
+	writesStoppedLock sync.Mutex
 }
 
+// Get is GetBytes for string keys
 func (eng *StorageEngine) Get(key string) ([]byte, error) {
-	hash := sha256.Sum256([]byte(key))
-	if keyDataInfo, ok := eng.offsetMap[hash]; ok {
-		buffer := make([]byte, keyDataInfo.length)
-		_, err := eng.dataFile.ReadAt(buffer, keyDataInfo.offset)
-		return buffer, err
-	} else {
-		return nil, nil
+	return eng.getContext(context.Background(), []byte(key))
+}
+
+// GetContext is Get that returns early with the context's error if it is already done
+func (eng *StorageEngine) GetContext(ctx context.Context, key string) ([]byte, error) {
+	return eng.getContext(ctx, []byte(key))
+}
+
+// GetBytes returns the value stored for key, or ErrNotFound. The value is a slice of the
+// buffer read from the data file and is not copied again, it belongs to the caller
+func (eng *StorageEngine) GetBytes(key []byte) ([]byte, error) {
+	return eng.getContext(context.Background(), key)
+}
+
+// View calls fn with the value stored for key, or returns ErrNotFound. With MmapReads a
+// value stored uncompressed and unencrypted is passed as a slice of the mapping, not a
+// copy, so it is only valid until fn returns and must not be changed. fn runs while the
+// engine holds its files open and must not call the engine
+func (eng *StorageEngine) View(key []byte, fn func(value []byte) error) error {
+	eng.filesLock.RLock()
+	defer eng.filesLock.RUnlock()
+	value, err := eng.readValue(key, true)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+// Exists reports whether key is set and has not expired. It only looks at the offset map,
+// so the value is not read and a value that cannot be read back still counts
+func (eng *StorageEngine) Exists(key []byte) (bool, error) {
+	eng.filesLock.RLock()
+	defer eng.filesLock.RUnlock()
+	if eng.closed {
+		return false, ErrClosed
+	}
+	info, ok := eng.offsetMap.get(sha256.Sum256(key))
+	return ok && !info.expired(time.Now().UnixNano()), nil
+}
+
+func (eng *StorageEngine) getContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	eng.filesLock.RLock()
+	defer eng.filesLock.RUnlock()
+	return eng.readValue(key, false)
 }
 
+// readValue looks up and decodes the value for key, the caller holds filesLock for
+// reading. When inPlace is set the value can be a slice of a segment's mapping
+func (eng *StorageEngine) readValue(key []byte, inPlace bool) ([]byte, error) {
+	if eng.closed {
+		return nil, ErrClosed
+	}
+	hash := sha256.Sum256(key)
+	keyDataInfo, ok := eng.offsetMap.get(hash)
+	if !ok || keyDataInfo.expired(time.Now().UnixNano()) {
+		return nil, ErrNotFound
+	}
+	segment := eng.segments[keyDataInfo.segment]
+	mapped, isMapped := segment.(*mappedFile)
+	entry, ok := []byte(nil), false
+	if inPlace && isMapped {
+		entry, ok = mapped.slice(keyDataInfo.offset, keyDataInfo.length)
+	}
+	if !ok {
+		entry = make([]byte, keyDataInfo.length)
+		if _, err := segment.ReadAt(entry, keyDataInfo.offset); err != nil {
+			return nil, err
+		}
+	}
+	storedKey, value, err := decodeDataEntry(entry, keyDataInfo.offset, eng.cipher)
+	if err != nil {
+		return nil, err
+	}
+	if entryFlags(entry[4]).keyHashed() {
+		key = hash[:]
+	}
+	if !bytes.Equal(storedKey, key) {
+		// a different key with the same hash
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// Shutdown stops the processors and closes the files, calling it again does nothing
 func (eng *StorageEngine) Shutdown() {
-	eng.shutdownTriggerChannel <- shutdown{}
+	eng.shutdownOnce.Do(eng.shutdown)
+}
+
+func (eng *StorageEngine) shutdown() {
+	// closing the trigger wakes both processors, a single send would only reach one of them
+	close(eng.shutdownTriggerChannel)
 	mapShutdown := false
 	dataShutdown := false
 	for !(mapShutdown && dataShutdown) {
@@ -130,13 +509,19 @@ func (eng *StorageEngine) Shutdown() {
 			mapShutdown = true
 		}
 	}
-	close(eng.shutdownTriggerChannel)
+	// the write channels are left open, writers select on the closed trigger instead and
+	// get ErrClosed rather than a panic
 	close(eng.shutdownResponseChannel)
-	close(eng.dataChannel)
-	close(eng.mapChannel)
-	dataCloseErr := eng.dataFile.Close()
-	if dataCloseErr != nil {
-		log.Printf("Error closing data file: %s\n", dataCloseErr.Error())
+	eng.filesLock.Lock()
+	eng.closed = true
+	eng.filesLock.Unlock()
+	if err := eng.saveHint(); err != nil {
+		log.Printf("Error writing hint file: %s\n", err.Error())
+	}
+	for _, segment := range eng.segments {
+		if dataCloseErr := segment.Close(); dataCloseErr != nil {
+			log.Printf("Error closing data file: %s\n", dataCloseErr.Error())
+		}
 	}
 	mapCloseErr := eng.mapFile.Close()
 	if mapCloseErr != nil {
@@ -144,94 +529,355 @@ func (eng *StorageEngine) Shutdown() {
 	}
 }
 
+// the processors block in select until there is work for them, every Set passes through
+// the data processor and then the map processor so writes are applied in the order they
+// were accepted
 func (eng *StorageEngine) processDataChannel() {
 	for {
 		select {
 		case data := <-eng.dataChannel:
+			if err := eng.stoppedError(); err != nil {
+				data.responseChannel <- err
+				continue
+			}
+			if err := eng.rollSegment(int64(len(data.value))); err != nil {
+				log.Printf("Error starting data segment: %s\n", err.Error())
+				data.responseChannel <- err
+				continue
+			}
 			bytesWritten, err := eng.dataFile.Write(data.value)
 			offset := eng.dataFileLength
-			eng.dataFileLength += int64(bytesWritten)
 			if err != nil {
 				log.Printf("Error writing data: %s\n", err.Error())
-				data.responseChannel <- 1
+				eng.undoDataWrite()
+				data.responseChannel <- err
 			} else {
-				info := dataInfo{offset, int64(bytesWritten)}
+				eng.dataFileLength += int64(bytesWritten)
+				info := dataInfo{eng.dataSegment, offset, int64(bytesWritten), data.expiry}
 				mapData := dataToMap{data.key, info, data.responseChannel}
-				eng.mapChannel <- mapData
+				select {
+				case eng.mapChannel <- mapData:
+				case <-eng.shutdownTriggerChannel:
+					// the map processor may already have stopped, recovery drops the
+					// unmapped value next time the files are opened
+					data.responseChannel <- ErrClosed
+				}
 			}
+		case batch := <-eng.dataBatchChannel:
+			eng.writeBatchData(batch)
+		case resume := <-eng.dataPauseChannel:
+			<-resume
 		case <-eng.shutdownTriggerChannel:
 			eng.shutdownResponseChannel <- dataProcessorShutDown
 			return
-		default:
 		}
 	}
 }
 
 func (eng *StorageEngine) processMapChannel() {
+	var syncTick <-chan time.Time
+	if eng.syncMode == SyncGroupCommit {
+		var stop func()
+		syncTick, stop = syncTicks(eng.syncInterval)
+		defer stop()
+	}
 	for {
 		select {
 		case mapInfo := <-eng.mapChannel:
-			toWrite := append(mapInfo.key, mapInfo.dataInfo.toByteSlice()...)
+			if err := eng.stoppedError(); err != nil {
+				mapInfo.responseChannel <- err
+				continue
+			}
+			toWrite := encodeMapRecord(mapInfo.key, mapInfo.dataInfo)
 			bytesWritten, err := eng.mapFile.Write(toWrite)
-			eng.mapFileLength += int64(bytesWritten)
 			if err != nil {
 				log.Printf("Error writing map data: %s\n", err.Error())
-				mapInfo.responseChannel <- 1
+				eng.undoMapWrite()
+				mapInfo.responseChannel <- err
 			} else {
+				eng.mapFileLength += int64(bytesWritten)
 				var key [32]byte
 				copy(key[:], mapInfo.key[0:32])
-				eng.offsetMap[key] = mapInfo.dataInfo
-				mapInfo.responseChannel <- 0
+				eng.offsetMap.set(key, mapInfo.dataInfo)
+				eng.completeWrite(mapInfo.responseChannel)
 			}
+		case batch := <-eng.mapBatchChannel:
+			eng.writeBatchMap(batch)
+		case expired := <-eng.sweepChannel:
+			eng.writeExpiryTombstones(expired)
+		case <-syncTick:
+			eng.syncPending()
+		case resume := <-eng.mapPauseChannel:
+			<-resume
 		case <-eng.shutdownTriggerChannel:
+			eng.syncPending()
 			eng.shutdownResponseChannel <- mapProcessorShutDown
 			return
-		default:
 		}
 	}
 }
 
+// Set is Put for string keys and values
 func (eng *StorageEngine) Set(key string, value string) error {
-	responseChannel := make(chan int)
-	hashedKey := sha256.Sum256([]byte(key))
-	writeData := dataToWrite{hashedKey[:], []byte(value), responseChannel}
-	eng.dataChannel <- writeData
-	result := <-responseChannel
-	if result == 0 {
-		return nil
-	} else {
-		return errors.New("Error performing Set")
+	return eng.putContext(context.Background(), []byte(key), []byte(value), 0)
+}
+
+// SetContext is Set that gives up when ctx is done. If the write had already been handed
+// to the processors it may still be applied after SetContext has returned the context's error
+func (eng *StorageEngine) SetContext(ctx context.Context, key string, value string) error {
+	return eng.putContext(ctx, []byte(key), []byte(value), 0)
+}
+
+// Put stores value under key. Both are copied once, into the entry written to the data
+// file, so the caller is free to reuse them as soon as Put returns
+func (eng *StorageEngine) Put(key []byte, value []byte) error {
+	return eng.putContext(context.Background(), key, value, 0)
+}
+
+// putContext stores value under key until expiry, in unix nanoseconds, zero keeps it for good
+func (eng *StorageEngine) putContext(ctx context.Context, key []byte, value []byte, expiry int64) error {
+	// buffered so the processors never wait on a caller that has given up
+	responseChannel := make(chan error, 1)
+	hashedKey := sha256.Sum256(key)
+	if len(key) > maxKeyLength {
+		return ErrKeyTooLarge
+	}
+	entry, err := eng.encodeEntry(key, value)
+	if err != nil {
+		return err
+	}
+	writeData := dataToWrite{hashedKey[:], entry, responseChannel, expiry}
+	select {
+	case eng.dataChannel <- writeData:
+	case <-eng.shutdownTriggerChannel:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return eng.waitForWrite(ctx, "Set", responseChannel)
+}
+
+// undoMapWrite cuts whatever part of a failed write made it into the map file back off,
+// so the next record does not start part way through one. If that fails as well the
+// file is left as it is and writes are stopped
+func (eng *StorageEngine) undoMapWrite() {
+	if err := eng.mapFile.Truncate(eng.mapFileLength); err != nil {
+		eng.stopWrites(err)
+	}
+}
+
+// undoDataWrite is undoMapWrite for the data segment being written to
+func (eng *StorageEngine) undoDataWrite() {
+	if err := eng.dataFile.Truncate(eng.dataFileLength); err != nil {
+		eng.stopWrites(err)
+	}
+}
+
+// stopWrites has every write from now on refused, err is why
+func (eng *StorageEngine) stopWrites(err error) {
+	eng.writesStoppedLock.Lock()
+	defer eng.writesStoppedLock.Unlock()
+	if eng.writesStopped == nil {
+		log.Printf("Refusing writes until the engine is reopened: %s\n", err.Error())
+		eng.writesStopped = fmt.Errorf("%w: %v", ErrWritesStopped, err)
 	}
 }
 
-func NewStorageEngine(mapFile EngineFile, dataFile EngineFile) *StorageEngine {
+// stoppedError is the error writes are refused with, nil while they are accepted
+func (eng *StorageEngine) stoppedError() error {
+	eng.writesStoppedLock.Lock()
+	defer eng.writesStoppedLock.Unlock()
+	return eng.writesStopped
+}
+
+func (eng *StorageEngine) waitForWrite(ctx context.Context, op string, responseChannel chan error) error {
+	select {
+	case err := <-responseChannel:
+		return writeResult(op, err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Delete is DeleteBytes for string keys
+func (eng *StorageEngine) Delete(key string) error {
+	return eng.deleteContext(context.Background(), []byte(key))
+}
+
+// DeleteContext is Delete that gives up when ctx is done, like SetContext
+func (eng *StorageEngine) DeleteContext(ctx context.Context, key string) error {
+	return eng.deleteContext(ctx, []byte(key))
+}
+
+// DeleteBytes writes a tombstone for the key to the map file. There is nothing to write to
+// the data file so it goes straight to the map processor. Deleting a key that is not set
+// still succeeds
+func (eng *StorageEngine) DeleteBytes(key []byte) error {
+	return eng.deleteContext(context.Background(), key)
+}
+
+func (eng *StorageEngine) deleteContext(ctx context.Context, key []byte) error {
+	responseChannel := make(chan error, 1)
+	hashedKey := sha256.Sum256(key)
+	select {
+	case eng.mapChannel <- dataToMap{hashedKey[:], dataInfo{0, 0, tombstoneLength, 0}, responseChannel}:
+	case <-eng.shutdownTriggerChannel:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return eng.waitForWrite(ctx, "Delete", responseChannel)
+}
+
+func NewStorageEngine(mapFile EngineFile, dataFile EngineFile) (*StorageEngine, error) {
+	return NewStorageEngineWithConfig(mapFile, dataFile, StorageEngineConfig{})
+}
+
+// NewStorageEngineWithConfig uses the durability and segment settings from config. The
+// given files are already open, MapFilePath is only used to find the hint file and
+// DataFilePath to find and name the segments after the first, which is dataFile. Use Open
+// to have the engine open every file
+func NewStorageEngineWithConfig(mapFile EngineFile, dataFile EngineFile, config StorageEngineConfig) (*StorageEngine, error) {
+	if config.SegmentSize > 0 && config.DataFilePath == "" {
+		return nil, ErrMissingFilePath
+	}
+	if !config.Compression.valid() {
+		return nil, ErrUnknownCompression
+	}
+	segments := map[uint32]EngineFile{0: dataFile}
+	if config.DataFilePath != "" {
+		if err := openSegments(config.DataFilePath, segments); err != nil {
+			return nil, err
+		}
+	}
+	storageEngine, err := newStorageEngine(mapFile, segments, config)
+	if err != nil {
+		for id, segment := range segments {
+			if id != 0 {
+				segment.Close()
+			}
+		}
+		return nil, err
+	}
+	return storageEngine, nil
+}
+
+func newStorageEngine(mapFile EngineFile, segments map[uint32]EngineFile, config StorageEngineConfig) (*StorageEngine, error) {
 	storageEngine := new(StorageEngine)
+	storageEngine.segmentSize = config.SegmentSize
+	storageEngine.mapFilePath = config.MapFilePath
+	storageEngine.dataFilePath = config.DataFilePath
+	if config.DataFilePath != "" {
+		storageEngine.openSegment = func(id uint32) (EngineFile, error) {
+			return OpenFile(SegmentPath(config.DataFilePath, id))
+		}
+	}
+	storageEngine.syncMode = config.SyncMode
+	storageEngine.syncInterval = config.SyncInterval
+	if storageEngine.syncInterval <= 0 {
+		storageEngine.syncInterval = 10 * time.Millisecond
+	}
+	storageEngine.compression = config.Compression
+	storageEngine.cipher = newEntryCipher(config.KeyProvider)
+	storageEngine.mmapReads = config.MmapReads
+	storageEngine.sweepInterval = config.SweepInterval
+	if storageEngine.sweepInterval <= 0 {
+		storageEngine.sweepInterval = time.Second
+	}
 	storageEngine.dataChannel = make(chan dataToWrite)
 	storageEngine.mapChannel = make(chan dataToMap)
+	storageEngine.dataBatchChannel = make(chan batchToWrite)
+	storageEngine.mapBatchChannel = make(chan batchToMap)
+	storageEngine.sweepChannel = make(chan []indexEntry)
 	storageEngine.shutdownTriggerChannel = make(chan struct{})
 	storageEngine.shutdownResponseChannel = make(chan int)
-	storageEngine.offsetMap = parseOffsetMap(mapFile)
-	storageEngine.mapFile = mapFile
-	mapFileInfo, mapLengthErr := mapFile.Stat()
-	if mapLengthErr != nil {
-		log.Fatal("Failed to read map file length")
+	storageEngine.dataPauseChannel = make(chan chan struct{})
+	storageEngine.mapPauseChannel = make(chan chan struct{})
+	if err := checkFileHeader(mapFile, "map"); err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err := checkFileHeader(segment, "data"); err != nil {
+			return nil, err
+		}
 	}
-	storageEngine.mapFileLength = mapFileInfo.Size()
-	storageEngine.dataFile = dataFile
-	dataFileInfo, dataLengthErr := dataFile.Stat()
-	if dataLengthErr != nil {
-		log.Fatal("Failed to read data file length")
+	var hint hintState
+	if config.MapFilePath != "" {
+		storageEngine.hintPath = HintPath(config.MapFilePath)
+		hint = readHint(storageEngine.hintPath, mapFile)
 	}
-	storageEngine.dataFileLength = dataFileInfo.Size()
+	recovered, err := recoverFiles(mapFile, segments, hint)
+	if err != nil {
+		return nil, err
+	}
+	storageEngine.offsetMap = newOffsetIndexFromMap(recovered.offsetMap)
+	storageEngine.mapFile = mapFile
+	storageEngine.mapFileLength = recovered.mapLength
+	// recovery has finished truncating the files, so they can be mapped
+	for id, segment := range segments {
+		segments[id] = storageEngine.mapSegment(segment)
+	}
+	storageEngine.segments = segments
+	storageEngine.dataSegment = recovered.dataSegment
+	storageEngine.nextSegment = recovered.dataSegment + 1
+	storageEngine.dataFile = segments[recovered.dataSegment]
+	storageEngine.dataFileLength = recovered.dataLength
+	storageEngine.recovery = recovered.report
 	go storageEngine.processDataChannel()
 	go storageEngine.processMapChannel()
-	return storageEngine
+	go storageEngine.sweepExpiredKeys()
+	return storageEngine, nil
 }
 
-func OpenFile(path string) *os.File {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
+var ErrMissingFilePath = errors.New("toydb: MapFilePath and DataFilePath must be set")
+
+// Open opens, or creates, the files named in config and starts an engine on them. A
+// compaction interrupted by a crash is finished or thrown away first. The files are
+// closed again if the engine fails to start
+func Open(config StorageEngineConfig) (*StorageEngine, error) {
+	if config.MapFilePath == "" || config.DataFilePath == "" {
+		return nil, ErrMissingFilePath
+	}
+	if err := finishCompaction(config.MapFilePath, config.DataFilePath); err != nil {
+		return nil, err
+	}
+	mapFile, err := OpenFile(config.MapFilePath)
+	if err != nil {
+		return nil, err
+	}
+	dataFile, err := OpenFile(config.DataFilePath)
+	if err != nil {
+		mapFile.Close()
+		return nil, err
+	}
+	storageEngine, err := NewStorageEngineWithConfig(mapFile, dataFile, config)
 	if err != nil {
-		log.Fatal("Failed to open data file")
+		mapFile.Close()
+		dataFile.Close()
+		return nil, err
 	}
-	return file
-}
\ No newline at end of file
+	return storageEngine, nil
+}
+
+func OpenFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
+}
+
+// createFile is OpenFile for a file that starts out empty
+func createFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0755)
+}
+
+// syncDirectory flushes the directory holding path, so files renamed into it stay renamed
+// after a crash
+func syncDirectory(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
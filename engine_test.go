@@ -1,12 +1,18 @@
 package toydb
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func shouldEqual(t *testing.T, got interface{}, expected interface{}) {
@@ -15,14 +21,53 @@ func shouldEqual(t *testing.T, got interface{}, expected interface{}) {
 	}
 }
 
+func openTestFile(t *testing.T, path string) *os.File {
+	file, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	return file
+}
+
+func openTestEngineFiles(t *testing.T, mapPath string, dataPath string) *StorageEngine {
+	storageEngine, err := Open(StorageEngineConfig{MapFilePath: mapPath, DataFilePath: dataPath})
+	if err != nil {
+		t.Fatalf("Failed to open engine: %v", err)
+	}
+	return storageEngine
+}
+
+func openTestEngine(t *testing.T, dir string) *StorageEngine {
+	return openTestEngineFiles(t, filepath.Join(dir, "map"), filepath.Join(dir, "data"))
+}
+
+// openTestEngineWithConfig opens the engine in dir with the rest of its settings from config
+func openTestEngineWithConfig(t *testing.T, dir string, config StorageEngineConfig) *StorageEngine {
+	config.MapFilePath = filepath.Join(dir, "map")
+	config.DataFilePath = filepath.Join(dir, "data")
+	storageEngine, err := Open(config)
+	if err != nil {
+		t.Fatalf("Failed to open engine: %v", err)
+	}
+	return storageEngine
+}
+
+// withFileHeader puts a header in front of contents written without one
+func withFileHeader(kind string, contents []byte) *bytes.Reader {
+	return bytes.NewReader(append(encodeFileHeader(kind, time.Unix(0, 0)), contents...))
+}
+
 func Test_parseOffsetMap_returnsCorrectMapWhenOneKey(t *testing.T) {
-	fileContents := [48]byte{
+	fileContents := [64]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
 		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7B,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09}
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x43, 0x60, 0xB3, 0xDD}
 
 	expectedKey := [32]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
@@ -30,29 +75,36 @@ func Test_parseOffsetMap_returnsCorrectMapWhenOneKey(t *testing.T) {
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6}
 
-	var expectedValue dataInfo = dataInfo{123, 9}
+	var expectedValue dataInfo = dataInfo{0, 123, 9, 0}
 
 	expectedMap := map[[32]byte]dataInfo{expectedKey: expectedValue}
 
-	offsetMap := parseOffsetMap(bytes.NewReader(fileContents[:]))
+	offsetMap, err := parseOffsetMap(withFileHeader("map", fileContents[:]))
 
+	shouldEqual(t, err, nil)
 	shouldEqual(t, expectedMap, offsetMap)
 }
 
 func Test_parseOffsetMap_returnsCorrectMapWhenTwoKeys(t *testing.T) {
-	fileContents := [96]byte{
+	fileContents := [128]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
 		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7B,
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x43, 0x60, 0xB3, 0xDD,
 		0x17, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
 		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x02, 0x22, 0xE1, 0x59, 0xE7, 0xB2,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0F}
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0F,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x05, 0xA3, 0x8B, 0xF0}
 
 	expectedKey := [32]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
@@ -66,30 +118,37 @@ func Test_parseOffsetMap_returnsCorrectMapWhenTwoKeys(t *testing.T) {
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6}
 
-	var expectedValue dataInfo = dataInfo{123, 9}
-	var expectedValue2 dataInfo = dataInfo{2348832909234, 15}
+	var expectedValue dataInfo = dataInfo{0, 123, 9, 0}
+	var expectedValue2 dataInfo = dataInfo{0, 2348832909234, 15, 0}
 
 	expectedMap := map[[32]byte]dataInfo{expectedKey: expectedValue, expectedKey2: expectedValue2}
 
-	offsetMap := parseOffsetMap(bytes.NewReader(fileContents[:]))
+	offsetMap, err := parseOffsetMap(withFileHeader("map", fileContents[:]))
 
+	shouldEqual(t, err, nil)
 	shouldEqual(t, expectedMap, offsetMap)
 }
 
 func Test_parseOffsetMap_returnsMapWithLastValueWhenDuplicateKeys(t *testing.T) {
-	fileContents := [96]byte{
+	fileContents := [128]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
 		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7B,
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x43, 0x60, 0xB3, 0xDD,
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
 		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x02, 0x22, 0xE1, 0x59, 0xE7, 0xB2,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0F}
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0F,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x47, 0x9C, 0x8E, 0x97}
 
 	expectedKey := [32]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
@@ -97,12 +156,13 @@ func Test_parseOffsetMap_returnsMapWithLastValueWhenDuplicateKeys(t *testing.T)
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6}
 
-	var expectedValue dataInfo = dataInfo{2348832909234, 15}
+	var expectedValue dataInfo = dataInfo{0, 2348832909234, 15, 0}
 
 	expectedMap := map[[32]byte]dataInfo{expectedKey: expectedValue}
 
-	offsetMap := parseOffsetMap(bytes.NewReader(fileContents[:]))
+	offsetMap, err := parseOffsetMap(withFileHeader("map", fileContents[:]))
 
+	shouldEqual(t, err, nil)
 	shouldEqual(t, expectedMap, offsetMap)
 }
 
@@ -146,6 +206,8 @@ type mockWriteEngineFile struct {
 func (mockWriteEngineFile) Close() error                                  { return nil }
 func (mockWriteEngineFile) Stat() (os.FileInfo, error)                    { return nil, nil }
 func (mockWriteEngineFile) ReadAt(p []byte, off int64) (n int, err error) { return 0, nil }
+func (mockWriteEngineFile) Truncate(size int64) error                     { return nil }
+func (mockWriteEngineFile) Sync() error                                   { return nil }
 
 type mockReadEngineFile struct {
 	io.ReaderAt
@@ -154,6 +216,8 @@ type mockReadEngineFile struct {
 func (mockReadEngineFile) Close() error                      { return nil }
 func (mockReadEngineFile) Stat() (os.FileInfo, error)        { return nil, nil }
 func (mockReadEngineFile) Write(p []byte) (n int, err error) { return 0, nil }
+func (mockReadEngineFile) Truncate(size int64) error         { return nil }
+func (mockReadEngineFile) Sync() error                       { return nil }
 
 type mockErroredWriteEngineFile struct{}
 
@@ -161,11 +225,15 @@ func (mockErroredWriteEngineFile) Write(p []byte) (n int, err error)
 func (mockErroredWriteEngineFile) Close() error                                  { return nil }
 func (mockErroredWriteEngineFile) Stat() (os.FileInfo, error)                    { return nil, nil }
 func (mockErroredWriteEngineFile) ReadAt(p []byte, off int64) (n int, err error) { return 0, nil }
+func (mockErroredWriteEngineFile) Truncate(size int64) error                     { return nil }
+func (mockErroredWriteEngineFile) Sync() error                                   { return nil }
 
 func Test_StorageEngine_Get_returnsValueForKey(t *testing.T) {
 	dataFileContents := [48]byte{
-		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
-		0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10}
+		0x01, 0x02, 0x03, 0x44, 0xB1, 0xCD, 0x30, 0x00,
+		0x00, 0x00, 0x09, 0x72, 0x61, 0x6E, 0x64, 0x6F,
+		0x6D, 0x6B, 0x65, 0x79, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0A, 0x0B}
 
 	sha256Key := [32]byte{
 		0x52, 0xec, 0x14, 0x80, 0x30, 0x8a, 0x78, 0xb9,
@@ -174,9 +242,9 @@ func Test_StorageEngine_Get_returnsValueForKey(t *testing.T) {
 		0x7d, 0x47, 0x2a, 0x46, 0x2f, 0x10, 0x2f, 0x45}
 
 	storageEngine := new(StorageEngine)
-	storageEngine.dataFile = mockReadEngineFile{bytes.NewReader(dataFileContents[:])}
-	storageEngine.offsetMap = make(map[[32]byte]dataInfo)
-	storageEngine.offsetMap[sha256Key] = dataInfo{3, 5}
+	storageEngine.segments = map[uint32]EngineFile{0: mockReadEngineFile{bytes.NewReader(dataFileContents[:])}}
+	storageEngine.offsetMap = newOffsetIndex()
+	storageEngine.offsetMap.set(sha256Key, dataInfo{0, 3, 22, 0})
 
 	result, err := storageEngine.Get("randomkey")
 
@@ -186,9 +254,9 @@ func Test_StorageEngine_Get_returnsValueForKey(t *testing.T) {
 	shouldEqual(t, err, nil)
 }
 
-func Test_StorageEngine_Get_returnsNilWhenKeyNotFound(t *testing.T) {
+func Test_StorageEngine_Get_returnsErrNotFoundWhenKeyNotFound(t *testing.T) {
 	storageEngine := new(StorageEngine)
-	storageEngine.offsetMap = make(map[[32]byte]dataInfo)
+	storageEngine.offsetMap = newOffsetIndex()
 
 	result, err := storageEngine.Get("randomkey")
 
@@ -197,8 +265,8 @@ func Test_StorageEngine_Get_returnsNilWhenKeyNotFound(t *testing.T) {
 	if result != nil {
 		t.Errorf("%d did not equal expected nil", result)
 	}
-	if err != nil {
-		t.Errorf("%d did not equal expected nil", err)
+	if err != ErrNotFound {
+		t.Errorf("%d did not equal expected ErrNotFound", err)
 	}
 }
 
@@ -214,9 +282,9 @@ func Test_StorageEngine_Get_returnsErrorWhenReadFails(t *testing.T) {
 		0x7d, 0x47, 0x2a, 0x46, 0x2f, 0x10, 0x2f, 0x45}
 
 	storageEngine := new(StorageEngine)
-	storageEngine.dataFile = mockReadEngineFile{bytes.NewReader(dataFileContents[:])}
-	storageEngine.offsetMap = make(map[[32]byte]dataInfo)
-	storageEngine.offsetMap[sha256Key] = dataInfo{3, 100}
+	storageEngine.segments = map[uint32]EngineFile{0: mockReadEngineFile{bytes.NewReader(dataFileContents[:])}}
+	storageEngine.offsetMap = newOffsetIndex()
+	storageEngine.offsetMap.set(sha256Key, dataInfo{0, 3, 100, 0})
 
 	_, err := storageEngine.Get("randomkey")
 
@@ -242,13 +310,13 @@ func Test_StorageEngine_processDataChannel_writesDataAndSendsInfoToMapChannel(t
 
 	value := [5]byte{0x01, 0x02, 0x03, 0x04, 0x05}
 
-	responseChannel := make(chan int)
-	storageEngine.dataChannel <- dataToWrite{key[:], value[:], responseChannel}
+	responseChannel := make(chan error)
+	storageEngine.dataChannel <- dataToWrite{key[:], value[:], responseChannel, 0}
 	mapData := <-storageEngine.mapChannel
 
 	shouldEqual(t, buf.Bytes(), value[:])
 	shouldEqual(t, storageEngine.dataFileLength, int64(5))
-	shouldEqual(t, mapData, dataToMap{key[:], dataInfo{0, 5}, responseChannel})
+	shouldEqual(t, mapData, dataToMap{key[:], dataInfo{0, 0, 5, 0}, responseChannel})
 }
 
 func Test_StorageEngine_processDataChannel_sendsToResponseChannelOnErr(t *testing.T) {
@@ -269,13 +337,13 @@ func Test_StorageEngine_processDataChannel_sendsToResponseChannelOnErr(t *testin
 
 	value := [5]byte{0x01, 0x02, 0x03, 0x04, 0x05}
 
-	responseChannel := make(chan int)
-	storageEngine.dataChannel <- dataToWrite{key[:], value[:], responseChannel}
+	responseChannel := make(chan error)
+	storageEngine.dataChannel <- dataToWrite{key[:], value[:], responseChannel, 0}
 	res := <-responseChannel
 
-	shouldEqual(t, res, 1)
-	//Should still update length for whatever number of bytes did get written to the data file
-	shouldEqual(t, storageEngine.dataFileLength, int64(2))
+	shouldEqual(t, res, errors.New("Broken"))
+	//The bytes that did get written are truncated off again so the length stays the same
+	shouldEqual(t, storageEngine.dataFileLength, int64(0))
 }
 
 func Test_StorageEngine_processDataChannel_shouldReturnWhenShutdownTriggerReceived(t *testing.T) {
@@ -299,8 +367,8 @@ func Test_StorageEngine_processMapChannel_writesMapDataAndUpdatesMap(t *testing.
 	storageEngine.mapChannel = make(chan dataToMap)
 	storageEngine.shutdownTriggerChannel = make(chan struct{})
 	storageEngine.shutdownResponseChannel = make(chan int)
-	storageEngine.offsetMap = make(map[[32]byte]dataInfo)
-	responseChannel := make(chan int)
+	storageEngine.offsetMap = newOffsetIndex()
+	responseChannel := make(chan error)
 
 	key := [32]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
@@ -308,32 +376,36 @@ func Test_StorageEngine_processMapChannel_writesMapDataAndUpdatesMap(t *testing.
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6}
 
-	expectedWrittenData := [48]byte{
+	expectedWrittenData := [64]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
 		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0C,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0F}
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0F,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x65, 0xC5, 0x3F, 0x5A}
 
-	info := dataInfo{12, 15}
+	info := dataInfo{0, 12, 15, 0}
 	go storageEngine.processMapChannel()
 	storageEngine.mapChannel <- dataToMap{key[:], info, responseChannel}
 
-	shouldEqual(t, <-responseChannel, 0)
-	shouldEqual(t, storageEngine.mapFileLength, int64(48))
+	shouldEqual(t, <-responseChannel, nil)
+	shouldEqual(t, storageEngine.mapFileLength, int64(64))
 	shouldEqual(t, buf.Bytes(), expectedWrittenData[:])
-	shouldEqual(t, storageEngine.offsetMap[key], info)
+	storedInfo, _ := storageEngine.offsetMap.get(key)
+	shouldEqual(t, storedInfo, info)
 }
 
-func Test_StorageEngine_processMapChannel_sendsOneToResponseChannelOnError(t *testing.T) {
+func Test_StorageEngine_processMapChannel_sendsErrorToResponseChannelOnError(t *testing.T) {
 	storageEngine := new(StorageEngine)
 	storageEngine.mapFile = mockErroredWriteEngineFile{}
 	storageEngine.mapChannel = make(chan dataToMap)
 	storageEngine.shutdownTriggerChannel = make(chan struct{})
 	storageEngine.shutdownResponseChannel = make(chan int)
-	storageEngine.offsetMap = make(map[[32]byte]dataInfo)
-	responseChannel := make(chan int)
+	storageEngine.offsetMap = newOffsetIndex()
+	responseChannel := make(chan error)
 
 	key := [32]byte{
 		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
@@ -341,13 +413,13 @@ func Test_StorageEngine_processMapChannel_sendsOneToResponseChannelOnError(t *te
 		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
 		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6}
 
-	info := dataInfo{12, 15}
+	info := dataInfo{0, 12, 15, 0}
 	go storageEngine.processMapChannel()
 	storageEngine.mapChannel <- dataToMap{key[:], info, responseChannel}
 
-	shouldEqual(t, <-responseChannel, 1)
-	shouldEqual(t, storageEngine.mapFileLength, int64(2))
-	_, ok := storageEngine.offsetMap[key]
+	shouldEqual(t, <-responseChannel, errors.New("Broken"))
+	shouldEqual(t, storageEngine.mapFileLength, int64(0))
+	_, ok := storageEngine.offsetMap.get(key)
 	shouldEqual(t, ok, false)
 }
 
@@ -366,24 +438,29 @@ func Test_StorageEngine_processMapChannel_shouldReturnWhenShutdownTriggerReceive
 
 func Test_StorageEngine_Shutdown_shouldReturnOnceProcessorsShutdown(t *testing.T) {
 	storageEngine := new(StorageEngine)
-	storageEngine.dataFile = mockReadEngineFile{}
+	storageEngine.segments = map[uint32]EngineFile{0: mockReadEngineFile{}}
 	storageEngine.mapFile = mockReadEngineFile{}
 	storageEngine.dataChannel = make(chan dataToWrite)
 	storageEngine.mapChannel = make(chan dataToMap)
 	storageEngine.shutdownTriggerChannel = make(chan struct{})
 	storageEngine.shutdownResponseChannel = make(chan int)
 
-	go storageEngine.Shutdown()
+	done := make(chan struct{})
+	go (func() {
+		storageEngine.Shutdown()
+		close(done)
+	})()
 	<-storageEngine.shutdownTriggerChannel
 
 	storageEngine.shutdownResponseChannel <- mapProcessorShutDown
 	storageEngine.shutdownResponseChannel <- dataProcessorShutDown
 
-	_, ok := <-storageEngine.mapChannel
+	<-done
+	_, ok := <-storageEngine.shutdownResponseChannel
 	shouldEqual(t, ok, false)
 }
 
-func Test_StorageEngine_Set_shouldReturnNoErrorWhenSuccessOnResponseChannel(t *testing.T) {
+func Test_StorageEngine_Set_shouldReturnNoErrorWhenNilOnResponseChannel(t *testing.T) {
 	storageEngine := new(StorageEngine)
 	storageEngine.dataFile = mockReadEngineFile{}
 	storageEngine.mapFile = mockReadEngineFile{}
@@ -402,8 +479,8 @@ func Test_StorageEngine_Set_shouldReturnNoErrorWhenSuccessOnResponseChannel(t *t
 		for {
 			info := <- storageEngine.dataChannel
 			shouldEqual(t, info.key, expectedKey[:])
-			shouldEqual(t, info.value, []byte("somedata"))
-			info.responseChannel <- 0
+			shouldEqual(t, info.value, append([]byte{0x12, 0xFD, 0x52, 0x80, 0x00, 0x00, 0x00, 0x07}, "testkeysomedata"...))
+			info.responseChannel <- nil
 		}
 	})()
 
@@ -414,7 +491,7 @@ func Test_StorageEngine_Set_shouldReturnNoErrorWhenSuccessOnResponseChannel(t *t
 	}
 }
 
-func Test_StorageEngine_Set_shouldReturnErrorWhenNonZeroOnResponseChannel(t *testing.T) {
+func Test_StorageEngine_Set_shouldReturnWriteErrorWhenErrorOnResponseChannel(t *testing.T) {
 	storageEngine := new(StorageEngine)
 	storageEngine.dataFile = mockReadEngineFile{}
 	storageEngine.mapFile = mockReadEngineFile{}
@@ -426,10 +503,440 @@ func Test_StorageEngine_Set_shouldReturnErrorWhenNonZeroOnResponseChannel(t *tes
 	go (func () {
 		for {
 			info := <- storageEngine.dataChannel
-			info.responseChannel <- 1
+			info.responseChannel <- errors.New("Broken")
 		}
 	})()
 
 	err := storageEngine.Set("testkey", "somedata")
-	shouldEqual(t, err, errors.New("Error performing Set"))
-}
\ No newline at end of file
+	shouldEqual(t, err, &WriteError{"Set", errors.New("Broken")})
+}
+func Test_parseOffsetMap_removesKeyWhenTombstoneFollows(t *testing.T) {
+	fileContents := [128]byte{
+		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
+		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
+		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
+		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7B,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x43, 0x60, 0xB3, 0xDD,
+		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
+		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
+		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
+		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xFD, 0x47, 0x24, 0xF7}
+
+	offsetMap, err := parseOffsetMap(withFileHeader("map", fileContents[:]))
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, offsetMap, map[[32]byte]dataInfo{})
+}
+
+func Test_StorageEngine_processMapChannel_removesKeyForTombstone(t *testing.T) {
+	storageEngine := new(StorageEngine)
+	var buf bytes.Buffer
+	storageEngine.mapFile = mockWriteEngineFile{&buf}
+	storageEngine.mapChannel = make(chan dataToMap)
+	storageEngine.shutdownTriggerChannel = make(chan struct{})
+	storageEngine.shutdownResponseChannel = make(chan int)
+	storageEngine.offsetMap = newOffsetIndex()
+	responseChannel := make(chan error)
+
+	key := [32]byte{
+		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
+		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
+		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
+		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6}
+
+	expectedWrittenData := [64]byte{
+		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
+		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
+		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
+		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xFD, 0x47, 0x24, 0xF7}
+
+	storageEngine.offsetMap.set(key, dataInfo{0, 12, 15, 0})
+	go storageEngine.processMapChannel()
+	storageEngine.mapChannel <- dataToMap{key[:], dataInfo{0, 0, tombstoneLength, 0}, responseChannel}
+
+	shouldEqual(t, <-responseChannel, nil)
+	shouldEqual(t, buf.Bytes(), expectedWrittenData[:])
+	_, ok := storageEngine.offsetMap.get(key)
+	shouldEqual(t, ok, false)
+}
+
+func Test_StorageEngine_Delete_sendsTombstoneToMapChannel(t *testing.T) {
+	storageEngine := new(StorageEngine)
+	storageEngine.mapChannel = make(chan dataToMap)
+
+	expectedKey := [32]byte{
+		0x98, 0x48, 0x3c, 0x6e, 0xb4, 0x0b, 0x6c, 0x31,
+		0xa4, 0x48, 0xc2, 0x2a, 0x66, 0xde, 0xd3, 0xb5,
+		0xe5, 0xe8, 0xd5, 0x11, 0x9c, 0xac, 0x83, 0x27,
+		0xb6, 0x55, 0xc8, 0xb5, 0xc4, 0x83, 0x64, 0x89}
+
+	go (func() {
+		info := <-storageEngine.mapChannel
+		shouldEqual(t, info.key, expectedKey[:])
+		shouldEqual(t, info.dataInfo.isTombstone(), true)
+		info.responseChannel <- nil
+	})()
+
+	err := storageEngine.Delete("testkey")
+
+	shouldEqual(t, err, nil)
+}
+
+func Test_StorageEngine_Delete_keyStaysDeletedAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	shouldEqual(t, storageEngine.Set("deleted", "somedata"), nil)
+	shouldEqual(t, storageEngine.Set("kept", "otherdata"), nil)
+	shouldEqual(t, storageEngine.Delete("deleted"), nil)
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	deleted, err := storageEngine.Get("deleted")
+	shouldEqual(t, deleted == nil, true)
+	shouldEqual(t, err, ErrNotFound)
+	kept, err := storageEngine.Get("kept")
+	shouldEqual(t, kept, []byte("otherdata"))
+	shouldEqual(t, err, nil)
+}
+
+func Test_decodeDataEntry_splitsKeyAndValue(t *testing.T) {
+	key, value, err := decodeDataEntry(encodeDataEntry([]byte("somekey"), []byte("somevalue")), 0, nil)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, key, []byte("somekey"))
+	shouldEqual(t, value, []byte("somevalue"))
+}
+
+func Test_decodeDataEntry_returnsCorruptionErrorWhenKeyLengthTooLong(t *testing.T) {
+	entry := [10]byte{0xAE, 0xC7, 0xE2, 0x1D, 0x00, 0x00, 0x00, 0x03, 0x61, 0x62}
+
+	_, _, err := decodeDataEntry(entry[:], 7, nil)
+
+	shouldEqual(t, err, &CorruptionError{"data", 7, "key longer than entry"})
+}
+
+func Test_decodeDataEntry_returnsCorruptionErrorWhenChecksumMismatch(t *testing.T) {
+	entry := encodeDataEntry([]byte("somekey"), []byte("somevalue"))
+	entry[len(entry)-1] ^= 0x01
+
+	_, _, err := decodeDataEntry(entry, 12, nil)
+
+	shouldEqual(t, err, &CorruptionError{"data", 12, "checksum mismatch"})
+	shouldEqual(t, errors.Is(err, ErrCorrupted), true)
+}
+
+func Test_StorageEngine_Get_returnsNilWhenStoredKeyDiffers(t *testing.T) {
+	sha256Key := [32]byte{
+		0x52, 0xec, 0x14, 0x80, 0x30, 0x8a, 0x78, 0xb9,
+		0xf1, 0xc9, 0xc7, 0xd9, 0x65, 0x4d, 0x4a, 0x85,
+		0x81, 0x9c, 0x26, 0xb3, 0x3a, 0x32, 0xf5, 0xc2,
+		0x7d, 0x47, 0x2a, 0x46, 0x2f, 0x10, 0x2f, 0x45}
+
+	entry := encodeDataEntry([]byte("otherkey"), []byte("value"))
+	storageEngine := new(StorageEngine)
+	storageEngine.segments = map[uint32]EngineFile{0: mockReadEngineFile{bytes.NewReader(entry)}}
+	storageEngine.offsetMap = newOffsetIndex()
+	storageEngine.offsetMap.set(sha256Key, dataInfo{0, 0, int64(len(entry)), 0})
+
+	result, err := storageEngine.Get("randomkey")
+
+	shouldEqual(t, result == nil, true)
+	shouldEqual(t, err, ErrNotFound)
+}
+
+func Test_parseOffsetMap_returnsCorruptionErrorWhenChecksumMismatch(t *testing.T) {
+	fileContents := [128]byte{
+		0x07, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
+		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
+		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
+		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7B,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x43, 0x60, 0xB3, 0xDD,
+		0x17, 0x7F, 0x33, 0x77, 0xC2, 0xE9, 0xAE, 0xD3,
+		0x2C, 0xBA, 0xE1, 0xA9, 0xCC, 0x2C, 0x65, 0xDA,
+		0x3E, 0x3D, 0xD4, 0x58, 0xCF, 0x14, 0x04, 0xE1,
+		0xFB, 0xC6, 0xCD, 0x29, 0x75, 0x95, 0x37, 0xE6,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x02, 0x22, 0xE1, 0x59, 0xE7, 0xB2,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0F,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00}
+
+	_, err := parseOffsetMap(withFileHeader("map", fileContents[:]))
+
+	shouldEqual(t, err, &CorruptionError{"map", fileHeaderLength + 64, "checksum mismatch"})
+}
+
+func Test_StorageEngine_Get_returnsCorruptionErrorWhenValueDamagedOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	storageEngine.Set("testkey", "somedata")
+
+	damaged, _ := os.OpenFile(dir+"/data", os.O_WRONLY, 0)
+	damaged.WriteAt([]byte("X"), fileHeaderLength+16)
+	damaged.Close()
+
+	result, err := storageEngine.Get("testkey")
+
+	shouldEqual(t, result == nil, true)
+	shouldEqual(t, errors.Is(err, ErrCorrupted), true)
+}
+
+func Test_StorageEngine_Exists_onlyChecksTheOffsetMap(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("testkey", "somedata")
+	storageEngine.SetWithTTL("expired", "somedata", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	damaged, _ := os.OpenFile(dir+"/data", os.O_WRONLY, 0)
+	damaged.WriteAt([]byte("X"), fileHeaderLength+16)
+	damaged.Close()
+
+	exists, err := storageEngine.Exists([]byte("testkey"))
+	shouldEqual(t, err, nil)
+	shouldEqual(t, exists, true)
+	exists, _ = storageEngine.Exists([]byte("expired"))
+	shouldEqual(t, exists, false)
+	exists, _ = storageEngine.Exists([]byte("missing"))
+	shouldEqual(t, exists, false)
+	storageEngine.Shutdown()
+	_, err = storageEngine.Exists([]byte("testkey"))
+	shouldEqual(t, err, ErrClosed)
+}
+
+func Test_Open_returnsErrorWhenPathsMissing(t *testing.T) {
+	storageEngine, err := Open(StorageEngineConfig{MapFilePath: "map"})
+
+	shouldEqual(t, storageEngine == nil, true)
+	shouldEqual(t, err, ErrMissingFilePath)
+}
+
+func Test_Open_returnsErrorWhenFileCannotBeOpened(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine, err := Open(StorageEngineConfig{
+		MapFilePath:  filepath.Join(dir, "map"),
+		DataFilePath: filepath.Join(dir, "missing", "data")})
+
+	shouldEqual(t, storageEngine == nil, true)
+	shouldEqual(t, errors.Is(err, os.ErrNotExist), true)
+}
+
+func Test_Open_returnsErrorWhenMapFileCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("a", "1")
+	storageEngine.Set("b", "2")
+	storageEngine.Shutdown()
+	damaged, _ := os.OpenFile(filepath.Join(dir, "map"), os.O_WRONLY, 0)
+	damaged.WriteAt([]byte{0xFF}, fileHeaderLength+3)
+	damaged.Close()
+	// without the hint the whole map file is replayed
+	os.Remove(HintPath(filepath.Join(dir, "map")))
+
+	storageEngine, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+
+	shouldEqual(t, storageEngine == nil, true)
+	shouldEqual(t, errors.Is(err, ErrCorrupted), true)
+}
+
+type erroredStatEngineFile struct {
+	mockReadEngineFile
+}
+
+func (erroredStatEngineFile) Stat() (os.FileInfo, error) { return nil, errors.New("Broken") }
+
+func Test_NewStorageEngine_returnsErrorWhenStatFails(t *testing.T) {
+	storageEngine, err := NewStorageEngine(erroredStatEngineFile{}, erroredStatEngineFile{})
+
+	shouldEqual(t, storageEngine == nil, true)
+	shouldEqual(t, err, errors.New("Broken"))
+}
+
+func BenchmarkStorageEngine_Set(b *testing.B) {
+	dir := b.TempDir()
+	storageEngine, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+	if err != nil {
+		b.Fatalf("Failed to open engine: %v", err)
+	}
+	defer storageEngine.Shutdown()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storageEngine.Set("key", "somedata")
+	}
+}
+
+// writeTestMapFile writes records map records for keys cycling through distinctKeys
+// different hashes, so a big map file does not need as big an offset map to load it
+func writeTestMapFile(tb testing.TB, path string, records int, distinctKeys int) {
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatalf("Failed to create %s: %v", path, err)
+	}
+	defer file.Close()
+	writer := bufio.NewWriterSize(file, mapReadChunk)
+	writer.Write(encodeFileHeader("map", time.Now()))
+	for i := 0; i < records; i++ {
+		key := sha256.Sum256([]byte(strconv.Itoa(i % distinctKeys)))
+		writer.Write(encodeMapRecord(key[:], dataInfo{0, int64(i) * 20, 20, 0}))
+	}
+	if err := writer.Flush(); err != nil {
+		tb.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func Test_parseOffsetMap_readsRecordsAcrossChunks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	records := 2*mapReadChunk/mapRecordLength + 10
+	writeTestMapFile(t, path, records, records)
+	appendToFile(t, path, make([]byte, 7))
+	file := openTestFile(t, path)
+	defer file.Close()
+
+	offsetMap, err := parseOffsetMap(file)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, len(offsetMap), records)
+	last := sha256.Sum256([]byte(strconv.Itoa(records - 1)))
+	shouldEqual(t, offsetMap[last], dataInfo{0, int64(records-1) * 20, 20, 0})
+}
+
+// BenchmarkParseOffsetMap loads map files of increasing size, the largest is 10M records
+// (640MB) so it takes a while to generate. Run it with -bench ParseOffsetMap -benchtime 1x
+func BenchmarkParseOffsetMap(b *testing.B) {
+	for _, records := range []int{100000, 1000000, 10000000} {
+		b.Run(strconv.Itoa(records), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "map")
+			writeTestMapFile(b, path, records, 1000000)
+			file, err := os.Open(path)
+			if err != nil {
+				b.Fatalf("Failed to open %s: %v", path, err)
+			}
+			defer file.Close()
+			b.SetBytes(int64(records) * mapRecordLength)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := parseOffsetMap(file); err != nil {
+					b.Fatalf("Failed to parse map file: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func Test_StorageEngine_Put_storesBinaryKeysAndValues(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+	defer storageEngine.Shutdown()
+	key := []byte{0x00, 0xFF, 0x10}
+	value := []byte{0xDE, 0xAD, 0x00, 0xBE, 0xEF}
+
+	shouldEqual(t, storageEngine.Put(key, value), nil)
+	value[0] = 0x00
+
+	stored, err := storageEngine.GetBytes(key)
+	shouldEqual(t, err, nil)
+	shouldEqual(t, stored, []byte{0xDE, 0xAD, 0x00, 0xBE, 0xEF})
+	shouldEqual(t, storageEngine.DeleteBytes(key), nil)
+	_, err = storageEngine.GetBytes(key)
+	shouldEqual(t, err, ErrNotFound)
+}
+
+func Test_StorageEngine_Get_readsValuesWrittenWithPut(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+	defer storageEngine.Shutdown()
+
+	storageEngine.Put([]byte("key"), []byte("value"))
+
+	value, err := storageEngine.Get("key")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("value"))
+}
+
+func Test_StorageEngine_Get_returnsEmptyValueForKeySetToEmptyString(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+	defer storageEngine.Shutdown()
+
+	storageEngine.Set("empty", "")
+	value, err := storageEngine.Get("empty")
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte{})
+}
+
+func Test_StorageEngine_SetContext_returnsDeadlineExceededWhenProcessorsAreStuck(t *testing.T) {
+	storageEngine := new(StorageEngine)
+	storageEngine.dataChannel = make(chan dataToWrite)
+	storageEngine.shutdownTriggerChannel = make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := storageEngine.SetContext(ctx, "key", "value")
+
+	shouldEqual(t, err, context.DeadlineExceeded)
+}
+
+func Test_StorageEngine_SetContext_returnsWhenCancelledWhileWaitingForWrite(t *testing.T) {
+	storageEngine := new(StorageEngine)
+	storageEngine.dataChannel = make(chan dataToWrite)
+	storageEngine.shutdownTriggerChannel = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	accepted := make(chan dataToWrite)
+	go (func() {
+		data := <-storageEngine.dataChannel
+		cancel()
+		accepted <- data
+	})()
+
+	err := storageEngine.SetContext(ctx, "key", "value")
+
+	shouldEqual(t, err, context.Canceled)
+	// the processor can still answer without blocking
+	(<-accepted).responseChannel <- nil
+}
+
+func Test_StorageEngine_GetContext_returnsErrorWhenContextDone(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+	defer storageEngine.Shutdown()
+	storageEngine.Set("key", "value")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := storageEngine.GetContext(ctx, "key")
+	shouldEqual(t, err, context.Canceled)
+	value, err := storageEngine.GetContext(context.Background(), "key")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("value"))
+}
+
+func Test_StorageEngine_DeleteContext_removesKey(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.SetContext(context.Background(), "key", "value"), nil)
+	shouldEqual(t, storageEngine.DeleteContext(context.Background(), "key"), nil)
+
+	_, err := storageEngine.Get("key")
+	shouldEqual(t, err, ErrNotFound)
+}
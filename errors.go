@@ -0,0 +1,104 @@
+package toydb
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrNotFound is returned by Get when the key is not set. A key set to an empty value is
+// found and returns an empty, non-nil slice
+var ErrNotFound = errors.New("toydb: key not found")
+
+// ErrClosed is returned by writes made after Shutdown has been called
+var ErrClosed = errors.New("toydb: engine closed")
+
+// ErrWritesStopped is matched by the WriteError returned by every write made after the
+// engine failed to put its files back in a consistent state. Reads keep working and
+// reopening the engine repairs the files
+var ErrWritesStopped = errors.New("toydb: writes stopped after an unrecoverable write error")
+
+// ErrKeyTooLarge is returned by writes with a key over 16MB
+var ErrKeyTooLarge = errors.New("toydb: key too large")
+
+// ErrDiskFull is matched by a WriteError caused by the disk running out of space. Whatever
+// part of the write made it to disk is cut off again, so once space is freed later writes
+// and reopening the engine work as normal
+var ErrDiskFull = errors.New("toydb: disk full")
+
+// WriteError is returned when Set, Delete or Apply fail to write or sync the files. It
+// wraps the error from the file so errors.Is and errors.As can look through it
+type WriteError struct {
+	// Op is "Set", "Delete" or "Apply"
+	Op  string
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("toydb: error performing %s: %v", e.Op, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+func (e *WriteError) Is(target error) bool {
+	return target == ErrDiskFull && errors.Is(e.Err, syscall.ENOSPC)
+}
+
+// writeResult turns the answer from the processors into the error returned by op
+func writeResult(op string, err error) error {
+	if err == nil || err == ErrClosed {
+		return err
+	}
+	return &WriteError{op, err}
+}
+
+// ErrCorrupted is matched by every CorruptionError, use errors.Is to check for it
+var ErrCorrupted = errors.New("toydb: corrupted record")
+
+// CorruptionError reports a record that failed its checksum or could not be parsed
+type CorruptionError struct {
+	// File is either "data" or "map"
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("toydb: corrupted %s record at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupted
+}
+
+// ErrNeedsMigration is matched by a FormatError for files written in an older format, Migrate
+// upgrades them
+var ErrNeedsMigration = errors.New("toydb: files need migrating to the current format")
+
+// ErrUnsupportedVersion is matched by a FormatError for files written by a newer version of
+// toydb than this one
+var ErrUnsupportedVersion = errors.New("toydb: unsupported file format version")
+
+// FormatError is returned when a file's header does not carry the current FormatVersion.
+// Files from before the header was added are version 0
+type FormatError struct {
+	// File is either "data" or "map"
+	File    string
+	Version uint32
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("toydb: %s file is format version %d, expected %d", e.File, e.Version, FormatVersion)
+}
+
+func (e *FormatError) Is(target error) bool {
+	switch target {
+	case ErrNeedsMigration:
+		return e.Version < FormatVersion
+	case ErrUnsupportedVersion:
+		return e.Version > FormatVersion
+	}
+	return false
+}
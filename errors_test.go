@@ -0,0 +1,107 @@
+package toydb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fullDiskEngineFile struct {
+	*os.File
+}
+
+func (f fullDiskEngineFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+}
+
+func Test_StorageEngine_Set_returnsErrDiskFullWhenOutOfSpace(t *testing.T) {
+	dir := t.TempDir()
+	mapFile := openTestFile(t, filepath.Join(dir, "map"))
+	dataFile := openTestFile(t, filepath.Join(dir, "data"))
+	// the header goes in before the disk fills up
+	dataFile.Write(encodeFileHeader("data", time.Now()))
+	storageEngine, err := NewStorageEngine(mapFile, fullDiskEngineFile{dataFile})
+	if err != nil {
+		t.Fatalf("Failed to start engine: %v", err)
+	}
+	defer storageEngine.Shutdown()
+
+	err = storageEngine.Set("key", "value")
+
+	shouldEqual(t, errors.Is(err, ErrDiskFull), true)
+	var pathErr *os.PathError
+	shouldEqual(t, errors.As(err, &pathErr), true)
+	shouldEqual(t, pathErr.Err, error(syscall.ENOSPC))
+}
+
+func Test_StorageEngine_Set_leavesFilesConsistentWhenDiskFills(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine, mapFile, dataFile := openShortWriteTestEngine(t, dir)
+	storageEngine.Set("before", "value")
+
+	dataFile.failNextWrite(5)
+	shouldEqual(t, errors.Is(storageEngine.Set("data", "value"), ErrDiskFull), true)
+	mapFile.failNextWrite(10)
+	shouldEqual(t, errors.Is(storageEngine.Set("map", "value"), ErrDiskFull), true)
+	mapFile.failNextWrite(1)
+	shouldEqual(t, errors.Is(storageEngine.Delete("before"), ErrDiskFull), true)
+	shouldEqual(t, storageEngine.Set("after", "value"), nil)
+	storageEngine.Shutdown()
+
+	storageEngine, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+	shouldEqual(t, err, nil)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	for _, key := range []string{"before", "after"} {
+		value, err := storageEngine.Get(key)
+		shouldEqual(t, err, nil)
+		shouldEqual(t, value, []byte("value"))
+	}
+	for _, key := range []string{"data", "map"} {
+		_, err := storageEngine.Get(key)
+		shouldEqual(t, err, ErrNotFound)
+	}
+}
+
+func Test_WriteError_Is_doesNotMatchErrDiskFullForOtherErrors(t *testing.T) {
+	err := &WriteError{"Set", errors.New("Broken")}
+
+	shouldEqual(t, errors.Is(err, ErrDiskFull), false)
+	shouldEqual(t, err.Error(), "toydb: error performing Set: Broken")
+}
+
+func Test_StorageEngine_writesReturnErrClosedAfterShutdown(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+	storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Set("key", "value"), ErrClosed)
+	shouldEqual(t, storageEngine.Delete("key"), ErrClosed)
+	var batch WriteBatch
+	batch.Set("key", "value")
+	shouldEqual(t, storageEngine.Apply(&batch), ErrClosed)
+}
+
+func Test_StorageEngine_readsReturnErrClosedAfterShutdown(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("key", "value")
+	keys := storageEngine.Keys()
+	storageEngine.Shutdown()
+
+	_, err := storageEngine.Get("key")
+	shouldEqual(t, err, ErrClosed)
+	shouldEqual(t, keys.Next(), false)
+	shouldEqual(t, keys.Err(), ErrClosed)
+	err = storageEngine.Compact()
+	shouldEqual(t, err, ErrClosed)
+}
+
+func Test_StorageEngine_Shutdown_canBeCalledTwice(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+
+	storageEngine.Shutdown()
+	storageEngine.Shutdown()
+}
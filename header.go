@@ -0,0 +1,114 @@
+package toydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"time"
+)
+
+// FormatVersion is the version of the file format written by this version of toydb. Files
+// from before the header was added count as version 0
+const FormatVersion = 1
+
+// Every map file and data segment starts with a header so a file in another format is
+// refused rather than misread. 4 byte magic, 4 byte uint32 format version, 8 byte uint64
+// creation time in unix nanoseconds, 12 bytes kept for later, then a 4 byte uint32 CRC32C
+// of the first 28 bytes. Map records and data entries follow it
+const fileHeaderLength = 32
+
+var fileMagic = map[string]string{
+	"map":  "TDBM",
+	"data": "TDBD",
+}
+
+// fileHeader is a decoded header, kind is "map" or "data"
+type fileHeader struct {
+	kind    string
+	version uint32
+	created int64
+}
+
+func encodeFileHeader(kind string, created time.Time) []byte {
+	header := make([]byte, fileHeaderLength)
+	copy(header[0:4], fileMagic[kind])
+	binary.BigEndian.PutUint32(header[4:8], FormatVersion)
+	binary.BigEndian.PutUint64(header[8:16], uint64(created.UnixNano()))
+	binary.BigEndian.PutUint32(header[28:32], crc32.Checksum(header[0:28], crcTable))
+	return header
+}
+
+// errHeaderCutShort is returned for a file that ends part way through its header, which
+// only happens when a crash interrupts creating it
+var errHeaderCutShort = errors.New("toydb: file header cut short")
+
+// decodeFileHeader checks header is a kind file in the current format. header is the
+// start of the file and can be shorter than a whole header
+func decodeFileHeader(header []byte, kind string) (fileHeader, error) {
+	magic := []byte(fileMagic[kind])
+	if len(header) < fileHeaderLength {
+		if len(header) <= len(magic) && bytes.HasPrefix(magic, header) ||
+			len(header) > len(magic) && bytes.HasPrefix(header, magic) {
+			return fileHeader{}, errHeaderCutShort
+		}
+		return fileHeader{}, &FormatError{kind, 0}
+	}
+	if !bytes.Equal(header[0:4], magic) {
+		for otherKind, otherMagic := range fileMagic {
+			if string(header[0:4]) == otherMagic {
+				return fileHeader{}, &CorruptionError{kind, 0, "header belongs to a " + otherKind + " file"}
+			}
+		}
+		return fileHeader{}, &FormatError{kind, 0}
+	}
+	if crc32.Checksum(header[0:28], crcTable) != binary.BigEndian.Uint32(header[28:32]) {
+		return fileHeader{}, &CorruptionError{kind, 0, "header checksum mismatch"}
+	}
+	decoded := fileHeader{
+		kind:    kind,
+		version: binary.BigEndian.Uint32(header[4:8]),
+		created: int64(binary.BigEndian.Uint64(header[8:16])),
+	}
+	if decoded.version != FormatVersion {
+		return decoded, &FormatError{kind, decoded.version}
+	}
+	return decoded, nil
+}
+
+// readFileHeader reads and checks the header of file, an empty file returns io.EOF
+func readFileHeader(file io.ReaderAt, kind string) (fileHeader, error) {
+	header := make([]byte, fileHeaderLength)
+	readBytes, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return fileHeader{}, err
+	}
+	if readBytes == 0 {
+		return fileHeader{}, io.EOF
+	}
+	return decodeFileHeader(header[:readBytes], kind)
+}
+
+// checkFileHeader is run on every file as the engine opens them. An empty file is new and
+// is given a header, any other must already have one for the current format
+func checkFileHeader(file EngineFile, kind string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > 0 {
+		_, err := readFileHeader(file, kind)
+		if err != errHeaderCutShort {
+			return err
+		}
+		// there is nothing after a partial header, so the file can start again
+		log.Printf("Rewriting %s file header cut short by a crash\n", kind)
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+	}
+	_, err = file.Write(encodeFileHeader(kind, time.Now()))
+	return err
+}
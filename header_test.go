@@ -0,0 +1,88 @@
+package toydb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Open_writesHeadersToNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Shutdown()
+
+	for _, kind := range []string{"map", "data"} {
+		file, err := os.Open(filepath.Join(dir, kind))
+		shouldEqual(t, err, nil)
+		header, err := readFileHeader(file, kind)
+		shouldEqual(t, err, nil)
+		shouldEqual(t, header.version, uint32(FormatVersion))
+		shouldEqual(t, header.created >= before.UnixNano(), true)
+		shouldEqual(t, fileSize(t, file), int64(fileHeaderLength))
+		file.Close()
+	}
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Set("key", "value"), nil)
+}
+
+func Test_Open_returnsFormatErrorForFilesWithoutHeader(t *testing.T) {
+	dir := t.TempDir()
+	key := [32]byte{1}
+	os.WriteFile(filepath.Join(dir, "map"), encodeMapRecord(key[:], dataInfo{0, 0, 10, 0}), 0644)
+
+	_, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+
+	shouldEqual(t, err, &FormatError{"map", 0})
+	shouldEqual(t, errors.Is(err, ErrNeedsMigration), true)
+	shouldEqual(t, errors.Is(err, ErrUnsupportedVersion), false)
+}
+
+func Test_Open_returnsFormatErrorForNewerVersion(t *testing.T) {
+	dir := t.TempDir()
+	header := encodeFileHeader("data", time.Now())
+	binary.BigEndian.PutUint32(header[4:8], FormatVersion+1)
+	binary.BigEndian.PutUint32(header[28:32], crc32.Checksum(header[0:28], crcTable))
+	os.WriteFile(filepath.Join(dir, "data"), header, 0644)
+
+	_, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+
+	shouldEqual(t, err, &FormatError{"data", FormatVersion + 1})
+	shouldEqual(t, errors.Is(err, ErrUnsupportedVersion), true)
+}
+
+func Test_Open_returnsCorruptionErrorWhenFilesSwapped(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Shutdown()
+
+	_, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "data"), DataFilePath: filepath.Join(dir, "map")})
+
+	shouldEqual(t, err, &CorruptionError{"map", 0, "header belongs to a data file"})
+}
+
+func Test_Open_rewritesHeaderCutShort(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "map"), encodeFileHeader("map", time.Now())[:10], 0644)
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.mapFileLength, int64(fileHeaderLength))
+	shouldEqual(t, storageEngine.Set("key", "value"), nil)
+}
+
+func Test_decodeFileHeader_returnsCorruptionErrorWhenChecksumMismatch(t *testing.T) {
+	header := encodeFileHeader("map", time.Now())
+	header[10] ^= 0xFF
+
+	_, err := decodeFileHeader(header, "map")
+
+	shouldEqual(t, err, &CorruptionError{"map", 0, "header checksum mismatch"})
+}
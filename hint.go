@@ -0,0 +1,150 @@
+package toydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// A hint file holds the offset map as it was when the engine last shut down, so opening
+// the engine reads it in one go and only replays map records written after it.
+// 4 byte magic, 8 byte uint64 map length covered, 4 byte uint32 segment being written to,
+// 8 byte uint64 length of that segment, a copy of the last map record covered, 8 byte
+// uint64 entry count, then per entry a 32 byte key hash and the segment, offset, length and
+// expiry of its value. It ends with a 4 byte uint32 CRC32C of everything before it
+const hintMagic = "TDH2"
+
+const hintHeaderLength = 4 + 8 + 4 + 8 + mapRecordLength + 8
+const hintEntryLength = 32 + 28
+
+var errInvalidHint = errors.New("toydb: invalid hint file")
+
+// hintState is where replaying the map file can start from, the zero value replays all of it
+type hintState struct {
+	offsetMap   map[[32]byte]dataInfo
+	mapLength   int64
+	dataSegment uint32
+	dataLength  int64
+}
+
+// HintPath names the hint file kept next to a map file
+func HintPath(mapFilePath string) string {
+	return mapFilePath + ".hint"
+}
+
+func encodeHint(state hintState, lastRecord []byte) []byte {
+	hint := make([]byte, hintHeaderLength, hintHeaderLength+len(state.offsetMap)*hintEntryLength+4)
+	copy(hint[0:4], hintMagic)
+	binary.BigEndian.PutUint64(hint[4:12], uint64(state.mapLength))
+	binary.BigEndian.PutUint32(hint[12:16], state.dataSegment)
+	binary.BigEndian.PutUint64(hint[16:24], uint64(state.dataLength))
+	copy(hint[24:24+mapRecordLength], lastRecord)
+	binary.BigEndian.PutUint64(hint[24+mapRecordLength:hintHeaderLength], uint64(len(state.offsetMap)))
+	for key, info := range state.offsetMap {
+		hint = append(hint, key[:]...)
+		hint = append(hint, info.toByteSlice()...)
+	}
+	return binary.BigEndian.AppendUint32(hint, crc32.Checksum(hint, crcTable))
+}
+
+// decodeHint checks the hint against its checksum and against the map file, a hint left
+// behind by a different map file does not match the record it copied
+func decodeHint(hint []byte, mapFile io.ReaderAt) (hintState, error) {
+	var state hintState
+	if len(hint) < hintHeaderLength+4 || string(hint[0:4]) != hintMagic {
+		return state, errInvalidHint
+	}
+	body := hint[:len(hint)-4]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(hint[len(hint)-4:]) {
+		return state, errInvalidHint
+	}
+	state.mapLength = int64(binary.BigEndian.Uint64(body[4:12]))
+	state.dataSegment = binary.BigEndian.Uint32(body[12:16])
+	state.dataLength = int64(binary.BigEndian.Uint64(body[16:24]))
+	lastRecord := body[24 : 24+mapRecordLength]
+	count := binary.BigEndian.Uint64(body[24+mapRecordLength : hintHeaderLength])
+	entries := body[hintHeaderLength:]
+	if state.mapLength < fileHeaderLength+mapRecordLength || uint64(len(entries)) != count*hintEntryLength {
+		return state, errInvalidHint
+	}
+
+	mapRecord := make([]byte, mapRecordLength)
+	if _, err := mapFile.ReadAt(mapRecord, state.mapLength-mapRecordLength); err != nil || !bytes.Equal(mapRecord, lastRecord) {
+		return state, errInvalidHint
+	}
+
+	state.offsetMap = make(map[[32]byte]dataInfo, count)
+	for len(entries) > 0 {
+		var key [32]byte
+		copy(key[:], entries[0:32])
+		state.offsetMap[key] = dataInfo{
+			segment: binary.BigEndian.Uint32(entries[32:36]),
+			offset:  int64(binary.BigEndian.Uint64(entries[36:44])),
+			length:  int64(binary.BigEndian.Uint64(entries[44:52])),
+			expiry:  int64(binary.BigEndian.Uint64(entries[52:60])),
+		}
+		entries = entries[hintEntryLength:]
+	}
+	return state, nil
+}
+
+// readHint loads the hint file at path, a missing or unusable one means a full replay
+func readHint(path string, mapFile io.ReaderAt) hintState {
+	hint, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading hint file, replaying the whole map file: %s\n", err.Error())
+		}
+		return hintState{}
+	}
+	state, err := decodeHint(hint, mapFile)
+	if err != nil {
+		log.Printf("Ignoring hint file %s, replaying the whole map file\n", path)
+		return hintState{}
+	}
+	return state
+}
+
+// writeHint replaces the hint file at path. It is written to a temporary file first so a
+// crash part way through leaves the old hint, which still matches the start of the map file
+func writeHint(path string, state hintState, lastRecord []byte) error {
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(encodeHint(state, lastRecord)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// saveHint writes a hint for the engine's current state, it is called by Shutdown once
+// the processors have stopped
+func (eng *StorageEngine) saveHint() error {
+	if eng.hintPath == "" || eng.mapFileLength <= fileHeaderLength {
+		return nil
+	}
+	lastRecord := make([]byte, mapRecordLength)
+	if _, err := eng.mapFile.ReadAt(lastRecord, eng.mapFileLength-mapRecordLength); err != nil {
+		return err
+	}
+	return writeHint(eng.hintPath, hintState{
+		offsetMap:   eng.offsetMap.snapshot(),
+		mapLength:   eng.mapFileLength,
+		dataSegment: eng.dataSegment,
+		dataLength:  eng.dataFileLength,
+	}, lastRecord)
+}
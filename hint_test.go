@@ -0,0 +1,111 @@
+package toydb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func copyTestFile(t *testing.T, from string, to string) {
+	source, err := os.Open(from)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", from, err)
+	}
+	defer source.Close()
+	destination, err := os.Create(to)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", to, err)
+	}
+	defer destination.Close()
+	io.Copy(destination, source)
+}
+
+func Test_StorageEngine_Shutdown_writesHintThatSkipsReplay(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+	// damage a record the hint covers, only a full replay would read it
+	file, _ := os.OpenFile(filepath.Join(dir, "map"), os.O_WRONLY, 0)
+	file.WriteAt([]byte{0xFF}, fileHeaderLength+3)
+	file.Close()
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("value-b"))
+}
+
+func Test_NewStorageEngine_replaysRecordsWrittenAfterHint(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("c", "value-c")
+	storageEngine.Delete("a")
+	// copy the files as they are before Shutdown writes a new hint, as if the engine crashed
+	crashed := t.TempDir()
+	for _, name := range []string{"map", "data", "map.hint"} {
+		copyTestFile(t, filepath.Join(dir, name), filepath.Join(crashed, name))
+	}
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, crashed)
+	defer storageEngine.Shutdown()
+
+	_, err := storageEngine.Get("a")
+	shouldEqual(t, err, ErrNotFound)
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("value-b"))
+	c, _ := storageEngine.Get("c")
+	shouldEqual(t, c, []byte("value-c"))
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+}
+
+func Test_NewStorageEngine_ignoresHintFromAnotherMapFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+	other := t.TempDir()
+	writeTestDatabase(t, other, "c", "d", "e")
+	copyTestFile(t, filepath.Join(other, "map"), filepath.Join(dir, "map"))
+	copyTestFile(t, filepath.Join(other, "data"), filepath.Join(dir, "data"))
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	_, err := storageEngine.Get("a")
+	shouldEqual(t, err, ErrNotFound)
+	c, _ := storageEngine.Get("c")
+	shouldEqual(t, c, []byte("value-c"))
+}
+
+func Test_NewStorageEngine_ignoresDamagedHint(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+	file, _ := os.OpenFile(HintPath(filepath.Join(dir, "map")), os.O_WRONLY, 0)
+	file.WriteAt([]byte{0xFF}, 100)
+	file.Close()
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+}
+
+func Test_decodeHint_roundTripsEncodeHint(t *testing.T) {
+	state := hintState{offsetMap: make(map[[32]byte]dataInfo), mapLength: fileHeaderLength + mapRecordLength, dataSegment: 2, dataLength: 40}
+	for i := 0; i < 10; i++ {
+		var key [32]byte
+		copy(key[:], fmt.Sprintf("key%d", i))
+		state.offsetMap[key] = dataInfo{uint32(i % 3), int64(i * 10), 10, int64(i)}
+	}
+	lastRecord := encodeMapRecord(make([]byte, 32), dataInfo{0, 1, 2, 0})
+
+	decoded, err := decodeHint(encodeHint(state, lastRecord), withFileHeader("map", lastRecord))
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, decoded, state)
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package toydb
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func processCPUTime(t testing.TB) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		t.Fatalf("Failed to read CPU usage: %v", err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func Test_StorageEngine_usesNoCPUWhenIdle(t *testing.T) {
+	storageEngine := openTestEngine(t, t.TempDir())
+	defer storageEngine.Shutdown()
+
+	before := processCPUTime(t)
+	time.Sleep(200 * time.Millisecond)
+	used := processCPUTime(t) - before
+
+	// a spinning processor would burn the whole 200ms, twice over
+	if used > 50*time.Millisecond {
+		t.Errorf("%v of CPU used while idle, expected close to none", used)
+	}
+}
+
+func BenchmarkStorageEngine_idleCPU(b *testing.B) {
+	storageEngine, err := Open(StorageEngineConfig{MapFilePath: b.TempDir() + "/map", DataFilePath: b.TempDir() + "/data"})
+	if err != nil {
+		b.Fatalf("Failed to open engine: %v", err)
+	}
+	defer storageEngine.Shutdown()
+
+	before := processCPUTime(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(processCPUTime(b)-before)/float64(b.N), "cpu-ns/idle-ms")
+}
@@ -0,0 +1,120 @@
+package toydb
+
+import (
+	"sync"
+)
+
+const indexShardCount = 32
+
+// offsetIndex maps key hashes to where their values live. It is split into shards with
+// their own lock, so a write from the map processor only holds up readers of one shard
+// and Gets never wait on each other. Key hashes are sha256 so the first byte spreads
+// keys evenly across the shards
+type offsetIndex struct {
+	shards [indexShardCount]indexShard
+}
+
+type indexShard struct {
+	sync.RWMutex
+	entries map[[32]byte]dataInfo
+}
+
+func newOffsetIndex() *offsetIndex {
+	return newOffsetIndexFromMap(nil)
+}
+
+func newOffsetIndexFromMap(offsetMap map[[32]byte]dataInfo) *offsetIndex {
+	index := new(offsetIndex)
+	for i := range index.shards {
+		index.shards[i].entries = make(map[[32]byte]dataInfo)
+	}
+	for key, info := range offsetMap {
+		index.shard(key).entries[key] = info
+	}
+	return index
+}
+
+func (index *offsetIndex) shard(key [32]byte) *indexShard {
+	return &index.shards[key[0]%indexShardCount]
+}
+
+func (index *offsetIndex) get(key [32]byte) (dataInfo, bool) {
+	shard := index.shard(key)
+	shard.RLock()
+	info, ok := shard.entries[key]
+	shard.RUnlock()
+	return info, ok
+}
+
+// set stores the location of a key's value, a tombstone removes the key
+func (index *offsetIndex) set(key [32]byte, info dataInfo) {
+	shard := index.shard(key)
+	shard.Lock()
+	if info.isTombstone() {
+		delete(shard.entries, key)
+	} else {
+		shard.entries[key] = info
+	}
+	shard.Unlock()
+}
+
+func (index *offsetIndex) len() int {
+	count := 0
+	for i := range index.shards {
+		shard := &index.shards[i]
+		shard.RLock()
+		count += len(shard.entries)
+		shard.RUnlock()
+	}
+	return count
+}
+
+// snapshot copies the index one shard at a time, so it is only consistent as a whole
+// when nothing is writing to it
+func (index *offsetIndex) snapshot() map[[32]byte]dataInfo {
+	offsetMap := make(map[[32]byte]dataInfo)
+	for i := range index.shards {
+		shard := &index.shards[i]
+		shard.RLock()
+		for key, info := range shard.entries {
+			offsetMap[key] = info
+		}
+		shard.RUnlock()
+	}
+	return offsetMap
+}
+
+func (index *offsetIndex) hashes() [][32]byte {
+	hashes := make([][32]byte, 0, index.len())
+	for i := range index.shards {
+		shard := &index.shards[i]
+		shard.RLock()
+		for key := range shard.entries {
+			hashes = append(hashes, key)
+		}
+		shard.RUnlock()
+	}
+	return hashes
+}
+
+// indexEntry is a key hash and where its value was when it was read from the index
+type indexEntry struct {
+	key  [32]byte
+	info dataInfo
+}
+
+// expired returns the keys that had expired by now, in unix nanoseconds
+func (index *offsetIndex) expired(now int64) []indexEntry {
+	var entries []indexEntry
+	for i := range index.shards {
+		shard := &index.shards[i]
+		shard.RLock()
+		for key, info := range shard.entries {
+			if info.expired(now) {
+				entries = append(entries, indexEntry{key, info})
+			}
+		}
+		shard.RUnlock()
+	}
+	return entries
+}
@@ -0,0 +1,109 @@
+package toydb
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_offsetIndex_setGetAndTombstone(t *testing.T) {
+	index := newOffsetIndex()
+	key := sha256.Sum256([]byte("key"))
+
+	index.set(key, dataInfo{0, 12, 15, 0})
+	info, ok := index.get(key)
+	shouldEqual(t, info, dataInfo{0, 12, 15, 0})
+	shouldEqual(t, ok, true)
+	shouldEqual(t, index.len(), 1)
+
+	index.set(key, dataInfo{0, 0, tombstoneLength, 0})
+	_, ok = index.get(key)
+	shouldEqual(t, ok, false)
+	shouldEqual(t, index.len(), 0)
+}
+
+func Test_offsetIndex_snapshotAndHashesCoverEveryShard(t *testing.T) {
+	offsetMap := make(map[[32]byte]dataInfo)
+	for i := 0; i < 500; i++ {
+		offsetMap[sha256.Sum256([]byte(fmt.Sprintf("key%d", i)))] = dataInfo{0, int64(i), 1, 0}
+	}
+
+	index := newOffsetIndexFromMap(offsetMap)
+
+	shouldEqual(t, index.snapshot(), offsetMap)
+	shouldEqual(t, len(index.hashes()), 500)
+}
+
+func Test_StorageEngine_concurrentGetSetDeleteStress(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	const workers = 8
+	const keysPerWorker = 50
+
+	var group sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		group.Add(1)
+		go (func(w int) {
+			defer group.Done()
+			for i := 0; i < keysPerWorker; i++ {
+				key := fmt.Sprintf("worker%d:key%d", w, i)
+				if err := storageEngine.Set(key, "first"); err != nil {
+					t.Errorf("Set failed: %v", err)
+				}
+				if i%3 == 0 {
+					storageEngine.Delete(key)
+				} else {
+					storageEngine.Set(key, key)
+				}
+				// read keys other workers are writing at the same time
+				storageEngine.Get(fmt.Sprintf("worker%d:key%d", (w+1)%workers, i))
+			}
+		})(w)
+	}
+	group.Add(1)
+	go (func() {
+		defer group.Done()
+		err := storageEngine.Compact()
+		if err != nil {
+			t.Errorf("Compact failed: %v", err)
+		}
+	})()
+	group.Wait()
+
+	for w := 0; w < workers; w++ {
+		for i := 0; i < keysPerWorker; i++ {
+			key := fmt.Sprintf("worker%d:key%d", w, i)
+			value, err := storageEngine.Get(key)
+			if i%3 == 0 {
+				shouldEqual(t, err, ErrNotFound)
+			} else {
+				shouldEqual(t, err, nil)
+				shouldEqual(t, string(value), key)
+			}
+		}
+	}
+}
+
+func BenchmarkStorageEngine_Get_parallel(b *testing.B) {
+	dir := b.TempDir()
+	storageEngine, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+	if err != nil {
+		b.Fatalf("Failed to open engine: %v", err)
+	}
+	defer storageEngine.Shutdown()
+	for i := 0; i < 1000; i++ {
+		storageEngine.Set(fmt.Sprintf("key%d", i), "value")
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			storageEngine.Get(fmt.Sprintf("key%d", i%1000))
+			i++
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package toydb
+
+import (
+	"strings"
+	"time"
+)
+
+// KeyIterator walks the keys that were set when it was created. Each key is looked up
+// again as the iterator reaches it, so keys deleted since are skipped and compaction
+// can run in between calls to Next. Keys come back in no particular order, and values
+// Migrate brought over from before keys were stored are skipped
+type KeyIterator struct {
+	eng    *StorageEngine
+	prefix string
+	hashes [][32]byte
+	key    string
+	err    error
+}
+
+func (eng *StorageEngine) Keys() *KeyIterator {
+	return eng.Scan("")
+}
+
+// Scan iterates the keys that start with prefix
+func (eng *StorageEngine) Scan(prefix string) *KeyIterator {
+	eng.filesLock.RLock()
+	hashes := eng.offsetMap.hashes()
+	eng.filesLock.RUnlock()
+	return &KeyIterator{eng: eng, prefix: prefix, hashes: hashes}
+}
+
+func (it *KeyIterator) Next() bool {
+	for it.err == nil && len(it.hashes) > 0 {
+		hash := it.hashes[0]
+		it.hashes = it.hashes[1:]
+		key, ok, err := it.eng.readKey(hash)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if ok && strings.HasPrefix(key, it.prefix) {
+			it.key = key
+			return true
+		}
+	}
+	return false
+}
+
+func (it *KeyIterator) Key() string {
+	return it.key
+}
+
+// Err returns the error that stopped the iteration early, if any
+func (it *KeyIterator) Err() error {
+	return it.err
+}
+
+// readKey reads the original key stored in front of the value for a key hash, the whole
+// entry is read so its checksum can be verified
+func (eng *StorageEngine) readKey(hash [32]byte) (string, bool, error) {
+	eng.filesLock.RLock()
+	defer eng.filesLock.RUnlock()
+	if eng.closed {
+		return "", false, ErrClosed
+	}
+	info, ok := eng.offsetMap.get(hash)
+	if !ok || info.expired(time.Now().UnixNano()) {
+		return "", false, nil
+	}
+	entry := make([]byte, info.length)
+	if _, err := eng.segments[info.segment].ReadAt(entry, info.offset); err != nil {
+		return "", false, err
+	}
+	key, _, flags, err := splitDataEntry(entry, info.offset)
+	if err == nil && flags.keyHashed() {
+		// migrated from before keys were stored, there is no key to return
+		return "", false, nil
+	}
+	if err == nil && flags.encrypted() {
+		key, _, err = eng.cipher.open(entry, info.offset)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(key), true, nil
+}
@@ -0,0 +1,69 @@
+package toydb
+
+import (
+	"sort"
+	"testing"
+)
+
+func collectKeys(t *testing.T, it *KeyIterator) []string {
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if it.Err() != nil {
+		t.Errorf("%v did not equal expected nil", it.Err())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func Test_StorageEngine_Keys_returnsLiveKeys(t *testing.T) {
+	storageEngine := newTestEngine(t)
+	defer storageEngine.Shutdown()
+	storageEngine.Set("user:1", "a")
+	storageEngine.Set("user:2", "b")
+	storageEngine.Set("user:2", "c")
+	storageEngine.Set("session:1", "d")
+	storageEngine.Delete("user:1")
+
+	shouldEqual(t, collectKeys(t, storageEngine.Keys()), []string{"session:1", "user:2"})
+}
+
+func Test_StorageEngine_Scan_returnsKeysWithPrefix(t *testing.T) {
+	storageEngine := newTestEngine(t)
+	defer storageEngine.Shutdown()
+	storageEngine.Set("user:1", "a")
+	storageEngine.Set("user:2", "b")
+	storageEngine.Set("session:1", "c")
+
+	shouldEqual(t, collectKeys(t, storageEngine.Scan("user:")), []string{"user:1", "user:2"})
+	shouldEqual(t, collectKeys(t, storageEngine.Scan("nothing")), []string{})
+}
+
+func Test_StorageEngine_Scan_skipsKeysDeletedAfterItStarted(t *testing.T) {
+	storageEngine := newTestEngine(t)
+	defer storageEngine.Shutdown()
+	storageEngine.Set("a", "1")
+	storageEngine.Set("b", "2")
+
+	it := storageEngine.Keys()
+	storageEngine.Delete("a")
+	storageEngine.Set("c", "3")
+
+	shouldEqual(t, collectKeys(t, it), []string{"b"})
+}
+
+func Test_StorageEngine_Keys_survivesReopenAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngine(t, dir)
+	storageEngine.Set("a", "1")
+	storageEngine.Set("b", "2")
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	it := storageEngine.Keys()
+	storageEngine.Compact()
+
+	shouldEqual(t, collectKeys(t, it), []string{"a", "b"})
+}
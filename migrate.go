@@ -0,0 +1,258 @@
+package toydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// the baseline format had no header. Its map records were a 32 byte key hash, 8 byte
+// uint64 offset and 8 byte uint64 length with no checksum, a later record for a hash
+// replacing an earlier one, and its one data file held the values back to back with no
+// key or checksum
+const version0MapRecordLength = 48
+
+const migrateSuffix = ".migrate"
+
+// Migrate upgrades the database in the files named in config from the baseline format to
+// the current one, in place. Nothing can have the files open while it runs. Every value
+// still in the map is rewritten as a full entry. The baseline never stored keys, so these
+// entries hold the key's hash in its place: Get finds them as before, but Keys and Scan
+// skip them until they are set again. Both new files are written and synced next to the
+// old ones before either is renamed over them, the data file first, so Migrate can be run
+// again after it was interrupted. Values in a data file whose map file is empty were never
+// mapped and are dropped. Files already in the current format are left alone
+func Migrate(config StorageEngineConfig) error {
+	if config.MapFilePath == "" || config.DataFilePath == "" {
+		return ErrMissingFilePath
+	}
+	migrateMap, err := needsMigration(config.MapFilePath, "map")
+	if err != nil {
+		return err
+	}
+	if !migrateMap {
+		// a crash between the baseline writing its first value and the value's map record
+		// leaves an empty map file next to a data file that still needs migrating
+		migrateData, err := needsMigration(config.DataFilePath, "data")
+		if err != nil || !migrateData {
+			return err
+		}
+		mapMigrated, err := hasFileHeader(config.MapFilePath, "map")
+		if err != nil {
+			return err
+		}
+		if mapMigrated {
+			// Migrate always replaces the data file first, so it did not leave these files
+			return &FormatError{"data", 0}
+		}
+		log.Printf("Migrating data file with no map records, its values are dropped\n")
+	}
+	// the hint holds offsets from before the migration
+	if err := os.Remove(HintPath(config.MapFilePath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// until the map file has been renamed a second run still knows the database needs
+	// migrating. If the data file already has a header, a run that was interrupted
+	// replaced it and left the new map file on disk
+	dataMigrated, err := hasFileHeader(config.DataFilePath, "data")
+	if err != nil {
+		return err
+	}
+	if !dataMigrated {
+		if err := writeMigratedFiles(config.MapFilePath, config.DataFilePath); err != nil {
+			return err
+		}
+		if err := os.Rename(config.DataFilePath+migrateSuffix, config.DataFilePath); err != nil {
+			return err
+		}
+		if err := syncDirectory(config.DataFilePath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(config.MapFilePath+migrateSuffix, config.MapFilePath); err != nil {
+		return err
+	}
+	return syncDirectory(config.MapFilePath)
+}
+
+// needsMigration reports whether the file at path is from before the header was added, a
+// missing or empty file has nothing to migrate
+func needsMigration(path string, kind string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	_, err = readFileHeader(file, kind)
+	if err == nil || err == io.EOF {
+		return false, nil
+	}
+	if errors.Is(err, ErrNeedsMigration) {
+		return true, nil
+	}
+	return false, err
+}
+
+// hasFileHeader reports whether the file at path starts with a header for the current format
+func hasFileHeader(path string, kind string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	_, err = readFileHeader(file, kind)
+	if err == io.EOF || errors.Is(err, ErrNeedsMigration) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// version0Record is the latest record for a hash in a baseline map file, recordOffset is
+// where it was in the file
+type version0Record struct {
+	info         dataInfo
+	recordOffset int64
+}
+
+// readVersion0Map reads a baseline map file into the latest record for each hash, hashes
+// are in the order they were first set. A record cut short at the end of the file is
+// dropped, as opening a baseline engine did
+func readVersion0Map(file io.Reader) (map[[32]byte]version0Record, [][32]byte, error) {
+	offsetMap := make(map[[32]byte]version0Record)
+	var hashes [][32]byte
+	reader := bufio.NewReaderSize(file, mapReadChunk)
+	record := make([]byte, version0MapRecordLength)
+	for recordOffset := int64(0); ; recordOffset += version0MapRecordLength {
+		readBytes, err := io.ReadFull(reader, record)
+		if err == io.EOF {
+			return offsetMap, hashes, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Dropping map record cut short after %d bytes\n", readBytes)
+			return offsetMap, hashes, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var hash [32]byte
+		copy(hash[:], record[0:32])
+		if _, ok := offsetMap[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+		offsetMap[hash] = version0Record{
+			info: dataInfo{
+				offset: int64(binary.BigEndian.Uint64(record[32:40])),
+				length: int64(binary.BigEndian.Uint64(record[40:48])),
+			},
+			recordOffset: recordOffset,
+		}
+	}
+}
+
+// writeMigratedFiles writes the current format copies of a baseline database next to its
+// files. A value the map places outside the data file is a CorruptionError and nothing is
+// left behind
+func writeMigratedFiles(mapPath string, dataPath string) (err error) {
+	oldMap, err := os.OpenFile(mapPath, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer oldMap.Close()
+	offsetMap, hashes, err := readVersion0Map(oldMap)
+	if err != nil {
+		return err
+	}
+	oldData, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer oldData.Close()
+	dataStat, err := oldData.Stat()
+	if err != nil {
+		return err
+	}
+	mapStat, err := oldMap.Stat()
+	if err != nil {
+		return err
+	}
+
+	newMap, err := createMigrateFile(mapPath, "map", mapStat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	newData, err := createMigrateFile(dataPath, "data", dataStat.Mode().Perm())
+	if err != nil {
+		closeMigrateFile(newMap, err)
+		return err
+	}
+	defer func() {
+		err = closeMigrateFile(newData, err)
+		err = closeMigrateFile(newMap, err)
+	}()
+
+	dataLength := int64(fileHeaderLength)
+	for _, hash := range hashes {
+		record := offsetMap[hash]
+		info := record.info
+		if info.offset < 0 || info.length < 0 || info.offset > dataStat.Size()-info.length {
+			return &CorruptionError{"map", record.recordOffset, "value outside the data file"}
+		}
+		value := make([]byte, info.length)
+		if _, err := oldData.ReadAt(value, info.offset); err != nil {
+			return err
+		}
+		entry := encodeStoredEntry(hash[:], value, entryKeyHashed)
+		if _, err := newData.Write(entry); err != nil {
+			return err
+		}
+		if _, err := newMap.Write(encodeMapRecord(hash[:], dataInfo{0, dataLength, int64(len(entry)), 0})); err != nil {
+			return err
+		}
+		dataLength += int64(len(entry))
+	}
+	return nil
+}
+
+// migrateFile is a file being written next to the one it replaces
+type migrateFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func createMigrateFile(path string, kind string, perm os.FileMode) (*migrateFile, error) {
+	file, err := os.OpenFile(path+migrateSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	writer.Write(encodeFileHeader(kind, time.Now()))
+	return &migrateFile{writer, file}, nil
+}
+
+// closeMigrateFile flushes and syncs m unless err is already set, and removes it if
+// anything failed
+func closeMigrateFile(m *migrateFile, err error) error {
+	if err == nil {
+		err = m.Flush()
+	}
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(m.file.Name())
+	}
+	return err
+}
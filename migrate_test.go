@@ -0,0 +1,199 @@
+package toydb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeBaselineDatabase writes a database the way the baseline engine stored it, each
+// pair is a key and the value it was set to, in order
+func writeBaselineDatabase(t *testing.T, dir string, sets ...[2]string) {
+	var mapRecords, data []byte
+	for _, set := range sets {
+		mapRecords = append(mapRecords, baselineMapRecord(set[0], int64(len(data)), int64(len(set[1])))...)
+		data = append(data, set[1]...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), data, 0644); err != nil {
+		t.Fatalf("Failed to write data file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "map"), mapRecords, 0644); err != nil {
+		t.Fatalf("Failed to write map file: %v", err)
+	}
+}
+
+func baselineMapRecord(key string, offset int64, length int64) []byte {
+	record := make([]byte, version0MapRecordLength)
+	hash := sha256.Sum256([]byte(key))
+	copy(record[0:32], hash[:])
+	binary.BigEndian.PutUint64(record[32:40], uint64(offset))
+	binary.BigEndian.PutUint64(record[40:48], uint64(length))
+	return record
+}
+
+func migrateTestDatabase(t *testing.T, dir string) error {
+	return Migrate(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+}
+
+func Test_Migrate_upgradesBaselineDatabase(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir, [2]string{"a", "first-a"}, [2]string{"b", "value-b"}, [2]string{"a", "value-a"}, [2]string{"c", ""})
+	os.WriteFile(HintPath(filepath.Join(dir, "map")), []byte("stale hint"), 0644)
+	_, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+	shouldEqual(t, errors.Is(err, ErrNeedsMigration), true)
+
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+
+	_, err = os.Stat(HintPath(filepath.Join(dir, "map")))
+	shouldEqual(t, os.IsNotExist(err), true)
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	shouldEqual(t, storageEngine.mapFileLength, int64(fileHeaderLength+3*mapRecordLength))
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("value-b"))
+	c, err := storageEngine.Get("c")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, len(c), 0)
+}
+
+func Test_Migrate_keysAreListedOnceSetAgain(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir, [2]string{"a", "value-a"}, [2]string{"b", "value-b"})
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, collectKeys(t, storageEngine.Keys()), []string{})
+
+	shouldEqual(t, storageEngine.Set("b", "new-b"), nil)
+
+	shouldEqual(t, collectKeys(t, storageEngine.Keys()), []string{"b"})
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("new-b"))
+}
+
+func Test_Migrate_valuesSurviveCompactionAndRotateKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir, [2]string{"a", "value-a"})
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+	storageEngine := openTestEngine(t, dir)
+	shouldEqual(t, storageEngine.Compact(), nil)
+	storageEngine.Shutdown()
+
+	shouldEqual(t, RotateKeys(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data"), KeyProvider: testKeyRing(1, 1)}), nil)
+
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1)})
+	defer storageEngine.Shutdown()
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+	shouldEqual(t, collectKeys(t, storageEngine.Keys()), []string{})
+}
+
+func Test_Migrate_leavesCurrentFilesAlone(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	mapFile := openTestFile(t, filepath.Join(dir, "map"))
+	defer mapFile.Close()
+	mapSize := fileSize(t, mapFile)
+
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+
+	shouldEqual(t, fileSize(t, mapFile), mapSize)
+	_, err := os.Stat(HintPath(filepath.Join(dir, "map")))
+	shouldEqual(t, err, nil)
+}
+
+func Test_Migrate_finishesAfterBeingInterruptedBeforeRenamingMap(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir, [2]string{"a", "value-a"}, [2]string{"b", "value-b"})
+	// the first run got as far as replacing the data file
+	shouldEqual(t, writeMigratedFiles(filepath.Join(dir, "map"), filepath.Join(dir, "data")), nil)
+	shouldEqual(t, os.Rename(filepath.Join(dir, "data.migrate"), filepath.Join(dir, "data")), nil)
+
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("value-b"))
+}
+
+func Test_Migrate_startsAgainAfterBeingInterruptedWritingFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir, [2]string{"a", "value-a"})
+	os.WriteFile(filepath.Join(dir, "map.migrate"), []byte("cut short"), 0644)
+	os.WriteFile(filepath.Join(dir, "data.migrate"), []byte("cut short"), 0644)
+
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+}
+
+func Test_Migrate_dropsTornLastMapRecord(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir, [2]string{"a", "value-a"})
+	appendToFile(t, filepath.Join(dir, "map"), make([]byte, 20))
+
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.mapFileLength, int64(fileHeaderLength+mapRecordLength))
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+}
+
+func Test_Migrate_returnsCorruptionErrorAndKeepsFilesForValueOutsideDataFile(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir, [2]string{"a", "value-a"}, [2]string{"b", "value-b"})
+	appendToFile(t, filepath.Join(dir, "map"), baselineMapRecord("c", 10, 100))
+
+	err := migrateTestDatabase(t, dir)
+
+	shouldEqual(t, err, &CorruptionError{"map", 2 * version0MapRecordLength, "value outside the data file"})
+	_, err = os.Stat(filepath.Join(dir, "map.migrate"))
+	shouldEqual(t, os.IsNotExist(err), true)
+	_, err = os.Stat(filepath.Join(dir, "data.migrate"))
+	shouldEqual(t, os.IsNotExist(err), true)
+	needed, _ := needsMigration(filepath.Join(dir, "map"), "map")
+	shouldEqual(t, needed, true)
+	data, _ := os.ReadFile(filepath.Join(dir, "data"))
+	shouldEqual(t, data, []byte("value-avalue-b"))
+}
+
+func Test_Migrate_upgradesDataFileWithEmptyMap(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineDatabase(t, dir)
+	// the value was written but the crash came before its map record
+	appendToFile(t, filepath.Join(dir, "data"), []byte("never mapped"))
+
+	shouldEqual(t, migrateTestDatabase(t, dir), nil)
+
+	storageEngine := openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	shouldEqual(t, storageEngine.dataFileLength, int64(fileHeaderLength))
+	shouldEqual(t, storageEngine.Set("a", "value-a"), nil)
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+}
+
+func Test_Migrate_returnsFormatErrorForHeaderlessDataNextToCurrentMap(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir)
+	os.WriteFile(filepath.Join(dir, "data"), []byte("headerless"), 0644)
+
+	err := migrateTestDatabase(t, dir)
+
+	shouldEqual(t, err, &FormatError{"data", 0})
+}
@@ -0,0 +1,135 @@
+package toydb
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+)
+
+// mappedFile is a data segment read through a read only memory mapping, so reading a
+// value is a copy rather than a ReadAt syscall. Everything else goes to the file. The
+// mapping reaches past the end of the file to leave room for the values appended to it,
+// only the part known to be inside the file is read and the file is checked again when a
+// read goes past it. A mapping that runs out of room is replaced by a bigger one, the old
+// one stays mapped until Close because slices handed out by View can still point into it
+type mappedFile struct {
+	*os.File
+	mutex sync.RWMutex
+	data  []byte
+	// how much of data is inside the file
+	size    int64
+	retired [][]byte
+	// set when mapping failed, reads then go to the file
+	failed bool
+}
+
+var errMappingTooLarge = errors.New("toydb: data file too large to map")
+
+// the smallest mapping made, the address space is reserved but not used until the file
+// grows into it
+const minMappingLength = 1 << 20
+
+// mapSegment has a segment read through a mapping when the engine was opened with
+// MmapReads. Files that are not an *os.File, and every file on platforms without mmap,
+// are returned as they are
+func (eng *StorageEngine) mapSegment(file EngineFile) EngineFile {
+	osFile, ok := file.(*os.File)
+	if !eng.mmapReads || !mmapSupported || !ok {
+		return file
+	}
+	return &mappedFile{File: osFile}
+}
+
+func (m *mappedFile) ReadAt(p []byte, offset int64) (int, error) {
+	data, ok := m.slice(offset, int64(len(p)))
+	if !ok {
+		return m.File.ReadAt(p, offset)
+	}
+	return copy(p, data), nil
+}
+
+// slice returns length bytes at offset straight from the mapping. It is false when they
+// are not in the file or the file could not be mapped, the caller then reads the file
+func (m *mappedFile) slice(offset int64, length int64) ([]byte, bool) {
+	if offset < 0 || length < 0 {
+		return nil, false
+	}
+	m.mutex.RLock()
+	if offset+length <= m.size {
+		data := m.data[offset : offset+length : offset+length]
+		m.mutex.RUnlock()
+		return data, true
+	}
+	m.mutex.RUnlock()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if offset+length <= m.size {
+		return m.data[offset : offset+length : offset+length], true
+	}
+	if m.failed {
+		return nil, false
+	}
+	info, err := m.File.Stat()
+	if err != nil || offset+length > info.Size() {
+		return nil, false
+	}
+	if info.Size() > int64(len(m.data)) {
+		if err := m.grow(info.Size()); err != nil {
+			log.Printf("Error mapping data file, reading it instead: %s\n", err.Error())
+			m.failed = true
+			return nil, false
+		}
+	}
+	m.size = info.Size()
+	return m.data[offset : offset+length : offset+length], true
+}
+
+// grow replaces the mapping with one at least twice as long that covers size bytes
+func (m *mappedFile) grow(size int64) error {
+	length := 2 * int64(len(m.data))
+	if length < minMappingLength {
+		length = minMappingLength
+	}
+	for length < size {
+		length *= 2
+	}
+	if int64(int(length)) != length {
+		return errMappingTooLarge
+	}
+	data, err := mmap(m.File, int(length))
+	if err != nil {
+		return err
+	}
+	if m.data != nil {
+		m.retired = append(m.retired, m.data)
+	}
+	m.data = data
+	return nil
+}
+
+// Truncate keeps the mapping from being read past the new end of the file
+func (m *mappedFile) Truncate(size int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if size < m.size {
+		m.size = size
+	}
+	return m.File.Truncate(size)
+}
+
+func (m *mappedFile) Close() error {
+	m.mutex.Lock()
+	for _, data := range append(m.retired, m.data) {
+		if data == nil {
+			continue
+		}
+		if err := munmap(data); err != nil {
+			log.Printf("Error unmapping data file: %s\n", err.Error())
+		}
+	}
+	m.data, m.retired, m.size = nil, nil, 0
+	m.mutex.Unlock()
+	return m.File.Close()
+}
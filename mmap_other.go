@@ -0,0 +1,19 @@
+//go:build !unix
+
+package toydb
+
+import (
+	"errors"
+	"os"
+)
+
+// without mmap MmapReads is ignored and segments are read with ReadAt
+const mmapSupported = false
+
+func mmap(file *os.File, length int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func munmap(data []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package toydb
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+func mmap(file *os.File, length int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
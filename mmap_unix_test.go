@@ -0,0 +1,100 @@
+//go:build unix
+
+package toydb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"unsafe"
+)
+
+func Test_StorageEngine_Get_readsValuesAppendedAfterMapping(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{MmapReads: true})
+	defer storageEngine.Shutdown()
+	storageEngine.Set("first", "value")
+	value, err := storageEngine.Get("first")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("value"))
+
+	// enough to outgrow the first mapping
+	large := bytes.Repeat([]byte{'x'}, 64*1024)
+	for i := 0; i < 40; i++ {
+		shouldEqual(t, storageEngine.Put([]byte(fmt.Sprintf("key%d", i)), large), nil)
+		value, err := storageEngine.GetBytes([]byte(fmt.Sprintf("key%d", i)))
+		shouldEqual(t, err, nil)
+		shouldEqual(t, bytes.Equal(value, large), true)
+	}
+
+	mapped := storageEngine.segments[0].(*mappedFile)
+	shouldEqual(t, len(mapped.retired) > 0, true)
+	value, _ = storageEngine.Get("first")
+	shouldEqual(t, value, []byte("value"))
+}
+
+func Test_StorageEngine_View_passesSliceOfMapping(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{MmapReads: true})
+	defer storageEngine.Shutdown()
+	storageEngine.Set("key", "value")
+
+	var inMapping bool
+	err := storageEngine.View([]byte("key"), func(value []byte) error {
+		shouldEqual(t, value, []byte("value"))
+		data := storageEngine.segments[0].(*mappedFile).data
+		start := uintptr(unsafe.Pointer(&data[0]))
+		address := uintptr(unsafe.Pointer(&value[0]))
+		inMapping = address >= start && address < start+uintptr(len(data))
+		return nil
+	})
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, inMapping, true)
+}
+
+func Test_StorageEngine_View_returnsErrors(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{MmapReads: true})
+	storageEngine.Set("key", "value")
+	errView := errors.New("view failed")
+
+	shouldEqual(t, storageEngine.View([]byte("missing"), func([]byte) error { return nil }), ErrNotFound)
+	shouldEqual(t, storageEngine.View([]byte("key"), func([]byte) error { return errView }), errView)
+	storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.View([]byte("key"), func([]byte) error { return nil }), ErrClosed)
+}
+
+func Test_StorageEngine_Get_mappedWithSegmentsCompressionAndEncryption(t *testing.T) {
+	dir := t.TempDir()
+	config := StorageEngineConfig{
+		MmapReads:   true,
+		SegmentSize: 200,
+		Compression: CompressionFlate,
+		KeyProvider: testKeyRing(1, 1),
+	}
+	storageEngine := openTestEngineWithConfig(t, dir, config)
+	for i := 0; i < 20; i++ {
+		storageEngine.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d %s", i, bytes.Repeat([]byte("a"), i*10)))
+	}
+	shouldEqual(t, len(storageEngine.segments) > 1, true)
+	for _, segment := range storageEngine.segments {
+		_, ok := segment.(*mappedFile)
+		shouldEqual(t, ok, true)
+	}
+	err := storageEngine.Compact()
+	shouldEqual(t, err, nil)
+	_, ok := storageEngine.segments[0].(*mappedFile)
+	shouldEqual(t, ok, true)
+	storageEngine.Set("after", "compaction")
+
+	for i := 0; i < 20; i++ {
+		value, err := storageEngine.Get(fmt.Sprintf("key%d", i))
+		shouldEqual(t, err, nil)
+		shouldEqual(t, string(value), fmt.Sprintf("value%d %s", i, bytes.Repeat([]byte("a"), i*10)))
+	}
+	err = storageEngine.View([]byte("after"), func(value []byte) error {
+		shouldEqual(t, value, []byte("compaction"))
+		return nil
+	})
+	shouldEqual(t, err, nil)
+	storageEngine.Shutdown()
+}
@@ -0,0 +1,180 @@
+package toydb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// RecoveryReport describes what was repaired when the engine opened its files. A crash
+// during Set can leave a value in the data file with no map record pointing at it, or
+// only part of the map record
+type RecoveryReport struct {
+	// MapBytesTruncated counts trailing map bytes that were a partial or torn record, or
+	// pointed at data that never made it to the data file
+	MapBytesTruncated int64
+	// DataBytesTruncated counts trailing data bytes that no map record points at
+	DataBytesTruncated int64
+}
+
+func (r RecoveryReport) Repaired() bool {
+	return r.MapBytesTruncated > 0 || r.DataBytesTruncated > 0
+}
+
+type recoveredState struct {
+	offsetMap map[[32]byte]dataInfo
+	mapLength int64
+	// the last segment, the one writes carry on in, and its length
+	dataSegment uint32
+	dataLength  int64
+	report      RecoveryReport
+}
+
+// recoverFiles builds the offset map and truncates torn writes off the end of both files.
+// Only the last record can have been torn by a crash, a bad record anywhere else is
+// returned as corruption. A batch missing any of its records is truncated as a whole.
+// Writes only go to the last data segment so it is the only one that can need truncating,
+// a value cut short in any other segment is corruption.
+// Replay starts where the hint left off, the map records it covers were checked when it
+// was written
+func recoverFiles(mapFile EngineFile, segments map[uint32]EngineFile, hint hintState) (recoveredState, error) {
+	var state recoveredState
+	mapFileInfo, err := mapFile.Stat()
+	if err != nil {
+		return state, err
+	}
+	mapSize := mapFileInfo.Size()
+	segmentSizes := make(map[uint32]int64, len(segments))
+	for id, segment := range segments {
+		info, err := segment.Stat()
+		if err != nil {
+			return state, err
+		}
+		segmentSizes[id] = info.Size()
+		if id > state.dataSegment {
+			state.dataSegment = id
+		}
+	}
+	dataFile := segments[state.dataSegment]
+	dataSize := segmentSizes[state.dataSegment]
+
+	if !hintFits(hint, mapSize, segmentSizes) {
+		hint = hintState{}
+	}
+	state.offsetMap = hint.offsetMap
+	if state.offsetMap == nil {
+		state.offsetMap = make(map[[32]byte]dataInfo)
+	}
+	state.dataLength = fileHeaderLength
+	if hint.dataSegment == state.dataSegment && hint.dataLength > state.dataLength {
+		state.dataLength = hint.dataLength
+	}
+	replayFrom := hint.mapLength
+	if replayFrom < fileHeaderLength {
+		replayFrom = fileHeaderLength
+	}
+	var checkErr error
+	validMapEnd, err := forEachMapRecord(mapFile, replayFrom, func(records []mapRecord) bool {
+		// the last records written, their values may have been torn along with them
+		last := len(records) > 0 && records[len(records)-1].offset+2*mapRecordLength > mapSize
+		// a batch is only kept if every value in it made it to the data file
+		for _, record := range records {
+			info := record.info
+			if info.isTombstone() {
+				continue
+			}
+			segmentSize, ok := segmentSizes[info.segment]
+			if !ok {
+				checkErr = &CorruptionError{"map", record.offset, fmt.Sprintf("data segment %d is missing", info.segment)}
+				return false
+			}
+			// only the last batch written to the last segment can have been torn, earlier
+			// segments were finished before it was started
+			torn := last && info.segment == state.dataSegment
+			if info.offset+info.length > segmentSize {
+				if !torn {
+					checkErr = &CorruptionError{"map", record.offset, fmt.Sprintf("value runs past the end of data segment %d", info.segment)}
+				}
+				return false
+			}
+			if last {
+				entry := make([]byte, info.length)
+				if _, checkErr = segments[info.segment].ReadAt(entry, info.offset); checkErr != nil {
+					return false
+				}
+				if _, _, _, corruptErr := splitDataEntry(entry, info.offset); corruptErr != nil {
+					if !torn {
+						checkErr = corruptErr
+					}
+					return false
+				}
+			}
+		}
+		for _, record := range records {
+			info := record.info
+			if info.isTombstone() {
+				delete(state.offsetMap, record.keyHash)
+				continue
+			}
+			state.offsetMap[record.keyHash] = info
+			if end := info.offset + info.length; info.segment == state.dataSegment && end > state.dataLength {
+				state.dataLength = end
+			}
+		}
+		return true
+	})
+	if checkErr != nil {
+		return state, checkErr
+	}
+	var corruptErr *CorruptionError
+	if errors.As(err, &corruptErr) {
+		if corruptErr.Offset+mapRecordLength < mapSize {
+			return state, err
+		}
+		// a torn last record, validMapEnd is the start of it or of the batch it is in
+	} else if err != nil {
+		return state, err
+	}
+
+	state.mapLength = validMapEnd
+	if mapSize > validMapEnd {
+		if err := mapFile.Truncate(validMapEnd); err != nil {
+			return state, err
+		}
+		state.report.MapBytesTruncated = mapSize - validMapEnd
+	}
+	if dataSize > state.dataLength {
+		if err := dataFile.Truncate(state.dataLength); err != nil {
+			return state, err
+		}
+		state.report.DataBytesTruncated = dataSize - state.dataLength
+	}
+	if state.report.Repaired() {
+		log.Printf("Recovered from torn writes, truncated %d map bytes and %d data bytes\n",
+			state.report.MapBytesTruncated, state.report.DataBytesTruncated)
+	}
+	return state, nil
+}
+
+// hintFits checks a hint only points at data that is still there, segments can have been
+// deleted or truncated since it was written
+func hintFits(hint hintState, mapSize int64, segmentSizes map[uint32]int64) bool {
+	if hint.mapLength > mapSize {
+		return false
+	}
+	if size, ok := segmentSizes[hint.dataSegment]; hint.dataLength > 0 && (!ok || hint.dataLength > size) {
+		return false
+	}
+	for _, info := range hint.offsetMap {
+		size, ok := segmentSizes[info.segment]
+		if !ok || info.offset+info.length > size {
+			return false
+		}
+	}
+	return true
+}
+
+// Recovery reports what was repaired when the engine was opened
+func (eng *StorageEngine) Recovery() RecoveryReport {
+	return eng.recovery
+}
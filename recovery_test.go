@@ -0,0 +1,265 @@
+package toydb
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func writeTestDatabase(t *testing.T, dir string, keys ...string) {
+	storageEngine := openTestEngine(t, dir)
+	for _, key := range keys {
+		if err := storageEngine.Set(key, "value-"+key); err != nil {
+			t.Fatalf("Failed to set %s: %v", key, err)
+		}
+	}
+	storageEngine.Shutdown()
+}
+
+func appendToFile(t *testing.T, path string, data []byte) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	file.Write(data)
+}
+
+func recoverTestDatabase(t *testing.T, dir string) (recoveredState, error) {
+	mapFile := openTestFile(t, filepath.Join(dir, "map"))
+	defer mapFile.Close()
+	dataFile := openTestFile(t, filepath.Join(dir, "data"))
+	defer dataFile.Close()
+	return recoverFiles(mapFile, map[uint32]EngineFile{0: dataFile}, hintState{})
+}
+
+func Test_recoverFiles_reportsNothingForCleanFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report, RecoveryReport{})
+	shouldEqual(t, len(state.offsetMap), 2)
+	shouldEqual(t, state.mapLength, int64(fileHeaderLength+2*mapRecordLength))
+}
+
+func Test_recoverFiles_truncatesPartialMapRecord(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	appendToFile(t, filepath.Join(dir, "map"), make([]byte, 20))
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report, RecoveryReport{MapBytesTruncated: 20})
+	shouldEqual(t, state.mapLength, int64(fileHeaderLength+mapRecordLength))
+	info, _ := os.Stat(filepath.Join(dir, "map"))
+	shouldEqual(t, info.Size(), int64(fileHeaderLength+mapRecordLength))
+}
+
+func Test_recoverFiles_truncatesTornLastMapRecord(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	appendToFile(t, filepath.Join(dir, "map"), make([]byte, mapRecordLength))
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report, RecoveryReport{MapBytesTruncated: mapRecordLength})
+	shouldEqual(t, len(state.offsetMap), 1)
+}
+
+func Test_recoverFiles_truncatesDataWithoutMapRecord(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	orphan := encodeDataEntry([]byte("b"), []byte("never mapped"))
+	appendToFile(t, filepath.Join(dir, "data"), orphan)
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report, RecoveryReport{DataBytesTruncated: int64(len(orphan))})
+	shouldEqual(t, state.dataLength, int64(fileHeaderLength+len(encodeDataEntry([]byte("a"), []byte("value-a")))))
+}
+
+func Test_recoverFiles_dropsLastRecordWhenItsValueIsTorn(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+	entryLength := int64(len(encodeDataEntry([]byte("b"), []byte("value-b"))))
+	dataPath := filepath.Join(dir, "data")
+	info, _ := os.Stat(dataPath)
+	os.Truncate(dataPath, info.Size()-3)
+	appendToFile(t, dataPath, []byte("xyz"))
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report, RecoveryReport{MapBytesTruncated: mapRecordLength, DataBytesTruncated: entryLength})
+	_, ok := state.offsetMap[sha256.Sum256([]byte("b"))]
+	shouldEqual(t, ok, false)
+	_, ok = state.offsetMap[sha256.Sum256([]byte("a"))]
+	shouldEqual(t, ok, true)
+}
+
+func Test_recoverFiles_dropsRecordsPointingPastEndOfData(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+	entryLength := int64(len(encodeDataEntry([]byte("b"), []byte("value-b"))))
+	dataPath := filepath.Join(dir, "data")
+	info, _ := os.Stat(dataPath)
+	os.Truncate(dataPath, info.Size()-entryLength)
+
+	state, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, state.report, RecoveryReport{MapBytesTruncated: mapRecordLength})
+	shouldEqual(t, len(state.offsetMap), 1)
+}
+
+func Test_recoverFiles_returnsCorruptionErrorForDamageBeforeTheTail(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a", "b")
+	file, _ := os.OpenFile(filepath.Join(dir, "map"), os.O_WRONLY, 0)
+	file.WriteAt([]byte{0xFF}, fileHeaderLength+3)
+	file.Close()
+
+	_, err := recoverTestDatabase(t, dir)
+
+	shouldEqual(t, err, &CorruptionError{"map", fileHeaderLength, "checksum mismatch"})
+}
+
+func Test_NewStorageEngine_reopensAfterTornWriteAndKeepsWorking(t *testing.T) {
+	dir := t.TempDir()
+	writeTestDatabase(t, dir, "a")
+	appendToFile(t, filepath.Join(dir, "data"), encodeDataEntry([]byte("b"), []byte("orphan")))
+	appendToFile(t, filepath.Join(dir, "map"), make([]byte, 7))
+
+	storageEngine := openTestEngine(t, dir)
+	shouldEqual(t, storageEngine.Recovery().Repaired(), true)
+	shouldEqual(t, storageEngine.Set("c", "value-c"), nil)
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+	c, _ := storageEngine.Get("c")
+	shouldEqual(t, c, []byte("value-c"))
+}
+
+// shortWriteEngineFile writes only the first shortWrite bytes of the next write and then
+// fails it as if the disk had filled up. Later writes go through
+type shortWriteEngineFile struct {
+	*os.File
+	mutex         sync.Mutex
+	shortWrite    int
+	failNext      bool
+	truncateError error
+}
+
+func (f *shortWriteEngineFile) failNextWrite(shortWrite int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failNext = true
+	f.shortWrite = shortWrite
+}
+
+func (f *shortWriteEngineFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	failNext := f.failNext
+	f.failNext = false
+	f.mutex.Unlock()
+	if !failNext {
+		return f.File.Write(p)
+	}
+	written, _ := f.File.Write(p[:f.shortWrite])
+	return written, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+}
+
+func (f *shortWriteEngineFile) Truncate(size int64) error {
+	if f.truncateError != nil {
+		return f.truncateError
+	}
+	return f.File.Truncate(size)
+}
+
+func openShortWriteTestEngine(t *testing.T, dir string) (*StorageEngine, *shortWriteEngineFile, *shortWriteEngineFile) {
+	mapFile := &shortWriteEngineFile{File: openTestFile(t, filepath.Join(dir, "map"))}
+	dataFile := &shortWriteEngineFile{File: openTestFile(t, filepath.Join(dir, "data"))}
+	storageEngine, err := NewStorageEngine(mapFile, dataFile)
+	if err != nil {
+		t.Fatalf("Failed to start engine: %v", err)
+	}
+	return storageEngine, mapFile, dataFile
+}
+
+func Test_StorageEngine_Set_truncatesShortMapWrite(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine, mapFile, _ := openShortWriteTestEngine(t, dir)
+	mapFile.failNextWrite(10)
+
+	shouldEqual(t, storageEngine.Set("failed", "value") != nil, true)
+	for _, key := range []string{"a", "b", "c"} {
+		shouldEqual(t, storageEngine.Set(key, "value-"+key), nil)
+	}
+	shouldEqual(t, fileSize(t, mapFile), int64(fileHeaderLength+3*mapRecordLength))
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	for _, key := range []string{"a", "b", "c"} {
+		value, err := storageEngine.Get(key)
+		shouldEqual(t, err, nil)
+		shouldEqual(t, value, []byte("value-"+key))
+	}
+	_, err := storageEngine.Get("failed")
+	shouldEqual(t, err, ErrNotFound)
+}
+
+func Test_StorageEngine_Apply_truncatesShortDataWrite(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine, _, dataFile := openShortWriteTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	dataFile.failNextWrite(3)
+	var batch WriteBatch
+	batch.Set("failed", "value")
+
+	shouldEqual(t, storageEngine.Apply(&batch) != nil, true)
+	shouldEqual(t, fileSize(t, dataFile), int64(fileHeaderLength))
+	shouldEqual(t, storageEngine.Set("key", "value"), nil)
+
+	value, _ := storageEngine.Get("key")
+	shouldEqual(t, value, []byte("value"))
+}
+
+func Test_StorageEngine_Set_stopsWritesWhenShortWriteCannotBeUndone(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine, mapFile, _ := openShortWriteTestEngine(t, dir)
+	storageEngine.Set("before", "value")
+	mapFile.truncateError = errors.New("Broken")
+	mapFile.failNextWrite(10)
+
+	shouldEqual(t, storageEngine.Set("failed", "value") != nil, true)
+	err := storageEngine.Set("key", "value")
+	shouldEqual(t, errors.Is(err, ErrWritesStopped), true)
+	shouldEqual(t, errors.Is(storageEngine.Delete("before"), ErrWritesStopped), true)
+	value, _ := storageEngine.Get("before")
+	shouldEqual(t, value, []byte("value"))
+	storageEngine.Shutdown()
+
+	// the torn record is at the end of the map file, so opening again repairs it
+	storageEngine = openTestEngine(t, dir)
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery().MapBytesTruncated, int64(10))
+	value, _ = storageEngine.Get("before")
+	shouldEqual(t, value, []byte("value"))
+	shouldEqual(t, storageEngine.Set("key", "value"), nil)
+}
@@ -0,0 +1,161 @@
+package toydb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// Redis RESP2 framing, see https://redis.io/docs/reference/protocol-spec/
+// requests are either arrays of bulk strings or inline space separated commands
+
+const (
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024
+	// the most allocated for an argument or for the argument list ahead of the bytes
+	// arriving, so a request only holds as much memory as it has actually sent
+	readChunkLength = 64 * 1024
+)
+
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readLine fails for lines longer than the reader's buffer
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("too big request")
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func readLength(line []byte, max int) (int, error) {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length > max {
+		return 0, protocolError("invalid length")
+	}
+	return length, nil
+}
+
+// readCommand returns the arguments of the next request, an empty request (an inline
+// line of nothing but spaces or an empty array) gives a nil slice
+func readCommand(reader *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		// the line points into the reader's buffer so it has to be copied before splitting
+		fields := bytes.Fields(append([]byte(nil), line...))
+		if len(fields) == 0 {
+			return nil, nil
+		}
+		return fields, nil
+	}
+	count, err := readLength(line, maxArrayLength)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+	args := make([][]byte, 0, minInt(count, readChunkLength/8))
+	for i := 0; i < count; i++ {
+		header, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, protocolError("expected '$'")
+		}
+		length, err := readLength(header, maxBulkLength)
+		if err != nil || length < 0 {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg, err := readBulk(reader, length)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads a bulk string of length bytes and the CRLF after it. The buffer grows as
+// the bytes arrive rather than being allocated from the length up front
+func readBulk(reader *bufio.Reader, length int) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, 0, minInt(length+2, readChunkLength)))
+	if _, err := io.CopyN(buffer, reader, int64(length)+2); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	arg := buffer.Bytes()
+	if arg[length] != '\r' || arg[length+1] != '\n' {
+		return nil, protocolError("expected CRLF after bulk string")
+	}
+	return arg[:length], nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// respWriter relies on bufio.Writer keeping the first write error, callers check Flush
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) writeSimpleString(value string) {
+	w.WriteByte('+')
+	w.WriteString(value)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) writeError(message string) {
+	w.WriteByte('-')
+	w.WriteString(message)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) writeInteger(value int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(value, 10))
+	w.WriteString("\r\n")
+}
+
+// writeBulk writes a nil value as the RESP2 null bulk string
+func (w respWriter) writeBulk(value []byte) {
+	if value == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(value)))
+	w.WriteString("\r\n")
+	w.Write(value)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) writeArrayHeader(length int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(length))
+	w.WriteString("\r\n")
+}
@@ -0,0 +1,98 @@
+package toydb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func readTestCommand(input string) ([][]byte, error) {
+	return readCommand(bufio.NewReader(strings.NewReader(input)))
+}
+
+func Test_readCommand_parsesArrayOfBulkStrings(t *testing.T) {
+	args, err := readTestCommand("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$7\r\nva\r\nlue\r\n")
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, args, [][]byte{[]byte("SET"), []byte("key"), []byte("va\r\nlue")})
+}
+
+func Test_readCommand_parsesInlineCommand(t *testing.T) {
+	args, err := readTestCommand("GET  somekey\r\n")
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, args, [][]byte{[]byte("GET"), []byte("somekey")})
+}
+
+func Test_readCommand_returnsNilForEmptyRequests(t *testing.T) {
+	args, err := readTestCommand("\r\n")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, args == nil, true)
+
+	args, err = readTestCommand("   \r\n")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, args == nil, true)
+
+	args, err = readTestCommand("*0\r\n")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, args == nil, true)
+}
+
+func Test_readCommand_returnsProtocolErrorForMalformedRequests(t *testing.T) {
+	_, err := readTestCommand("*1\r\n:3\r\n")
+	shouldEqual(t, err, protocolError("expected '$'"))
+
+	_, err = readTestCommand("*x\r\n")
+	shouldEqual(t, err, protocolError("invalid length"))
+
+	_, err = readTestCommand("*1\r\n$3\r\nGETX\r\n")
+	shouldEqual(t, err, protocolError("expected CRLF after bulk string"))
+}
+
+func Test_readCommand_returnsUnexpectedEOFForTruncatedRequest(t *testing.T) {
+	_, err := readTestCommand("*2\r\n$3\r\nGET\r\n$3\r\nke")
+	shouldEqual(t, err, io.ErrUnexpectedEOF)
+
+	_, err = readTestCommand("")
+	shouldEqual(t, err, io.EOF)
+}
+
+func Test_readCommand_onlyAllocatesForBytesReceived(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, err := readTestCommand("*1000000\r\n$536870912\r\nabc")
+
+	runtime.ReadMemStats(&after)
+	shouldEqual(t, err, io.ErrUnexpectedEOF)
+	shouldEqual(t, after.TotalAlloc-before.TotalAlloc < 1024*1024, true)
+}
+
+func Test_readCommand_readsBulkStringLongerThanReadChunk(t *testing.T) {
+	value := strings.Repeat("v", 3*readChunkLength+1)
+
+	args, err := readTestCommand("*2\r\n$3\r\nGET\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, args, [][]byte{[]byte("GET"), []byte(value)})
+}
+
+func Test_respWriter_writesRepliesInRespFormat(t *testing.T) {
+	var buf bytes.Buffer
+	writer := respWriter{bufio.NewWriter(&buf)}
+
+	writer.writeSimpleString("OK")
+	writer.writeError("ERR broken")
+	writer.writeInteger(-12)
+	writer.writeArrayHeader(2)
+	writer.writeBulk([]byte("value"))
+	writer.writeBulk(nil)
+	writer.writeBulk([]byte{})
+	writer.Flush()
+
+	shouldEqual(t, buf.String(), "+OK\r\n-ERR broken\r\n:-12\r\n*2\r\n$5\r\nvalue\r\n$-1\r\n$0\r\n\r\n")
+}
@@ -0,0 +1,29 @@
+package toydb
+
+// RotateKeys re-encrypts every live value in the database named in config with the
+// current key from config.KeyProvider, after which older keys are no longer needed.
+// Values written before encryption was turned on are encrypted too. It opens the database
+// and compacts it, so nothing else can have it open while it runs. If it is interrupted
+// the next Open finishes or throws away the compaction like any other, either way every
+// value can still be read with the keys it was written with
+func RotateKeys(config StorageEngineConfig) error {
+	if config.KeyProvider == nil {
+		return ErrNoKeyProvider
+	}
+	storageEngine, err := Open(config)
+	if err != nil {
+		return err
+	}
+	defer storageEngine.Shutdown()
+	return storageEngine.compact(storageEngine.reencodeEntry)
+}
+
+// reencodeEntry decodes an entry and encodes it again with the engine's current key and
+// compression, an entry holding a key hash keeps it
+func (eng *StorageEngine) reencodeEntry(entry []byte, offset int64) ([]byte, error) {
+	key, value, err := decodeDataEntry(entry, offset, eng.cipher)
+	if err != nil {
+		return nil, err
+	}
+	return eng.encodeFlaggedEntry(key, value, entryFlags(entry[4])&entryKeyHashed)
+}
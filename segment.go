@@ -0,0 +1,103 @@
+package toydb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SegmentPath names a data file segment. The first segment is the data file itself, later
+// ones sit next to it with their id on the end, so data, data.000001, data.000002 and so on
+func SegmentPath(dataFilePath string, id uint32) string {
+	if id == 0 {
+		return dataFilePath
+	}
+	return fmt.Sprintf("%s.%06d", dataFilePath, id)
+}
+
+// listSegments returns the ids of the segments after the first found next to
+// dataFilePath. Ids can have gaps where old segments were deleted
+func listSegments(dataFilePath string) ([]uint32, error) {
+	entries, err := os.ReadDir(filepath.Dir(dataFilePath))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	prefix := filepath.Base(dataFilePath) + "."
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(entry.Name(), prefix), 10, 32)
+		if err != nil || id == 0 || filepath.Base(SegmentPath(dataFilePath, uint32(id))) != entry.Name() {
+			// not a segment, compaction files for example
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// openSegments opens every segment after the first found next to dataFilePath and adds
+// them to segments
+func openSegments(dataFilePath string, segments map[uint32]EngineFile) error {
+	ids, err := listSegments(dataFilePath)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		file, err := OpenFile(SegmentPath(dataFilePath, id))
+		if err != nil {
+			for id, segment := range segments {
+				if id != 0 {
+					segment.Close()
+				}
+			}
+			return err
+		}
+		segments[id] = file
+	}
+	return nil
+}
+
+// rollSegment starts a new segment when writing length more bytes would take the current
+// one past SegmentSize. A segment always takes at least one write, so a value bigger than
+// SegmentSize gets a segment to itself. Only the data processor calls it
+func (eng *StorageEngine) rollSegment(length int64) error {
+	if eng.segmentSize <= 0 || eng.openSegment == nil || eng.dataFileLength <= fileHeaderLength || eng.dataFileLength+length <= eng.segmentSize {
+		return nil
+	}
+	// the old segment is not written again, so a later sync of the new one must not
+	// leave its tail behind
+	if eng.syncMode != SyncNone {
+		if err := eng.dataFile.Sync(); err != nil {
+			return err
+		}
+	}
+	id := eng.nextSegment
+	file, err := eng.openSegment(id)
+	if err != nil {
+		return err
+	}
+	// ids only go up, so anything already in a file with this name was never mapped
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(encodeFileHeader("data", time.Now())); err != nil {
+		file.Close()
+		return err
+	}
+	file = eng.mapSegment(file)
+	eng.filesLock.Lock()
+	eng.segments[id] = file
+	eng.dataFile = file
+	eng.dataSegment = id
+	eng.dataFileLength = fileHeaderLength
+	eng.filesLock.Unlock()
+	eng.nextSegment = id + 1
+	return nil
+}
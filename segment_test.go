@@ -0,0 +1,189 @@
+package toydb
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_SegmentPath_namesSegmentsAfterDataFile(t *testing.T) {
+	shouldEqual(t, SegmentPath("dir/data", 0), "dir/data")
+	shouldEqual(t, SegmentPath("dir/data", 12), "dir/data.000012")
+}
+
+func Test_StorageEngine_Set_rollsOverToNewSegments(t *testing.T) {
+	dir := t.TempDir()
+	entryLength := int64(len(encodeDataEntry([]byte("key0"), []byte("value0"))))
+	segmentSize := fileHeaderLength + 2*entryLength
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: segmentSize})
+
+	for i := 0; i < 5; i++ {
+		shouldEqual(t, storageEngine.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)), nil)
+	}
+
+	shouldEqual(t, storageEngine.dataSegment, uint32(2))
+	for _, id := range []uint32{0, 1, 2} {
+		info, err := os.Stat(SegmentPath(filepath.Join(dir, "data"), id))
+		shouldEqual(t, err, nil)
+		if info.Size() > segmentSize {
+			t.Errorf("segment %d is %d bytes, over the %d byte limit", id, info.Size(), segmentSize)
+		}
+	}
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: segmentSize})
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	for i := 0; i < 5; i++ {
+		value, err := storageEngine.Get(fmt.Sprintf("key%d", i))
+		shouldEqual(t, err, nil)
+		shouldEqual(t, value, []byte(fmt.Sprintf("value%d", i)))
+	}
+	// writes carry on in the last segment
+	storageEngine.Set("key5", "value5")
+	shouldEqual(t, storageEngine.dataSegment, uint32(2))
+}
+
+func Test_StorageEngine_Apply_keepsBatchInOneSegment(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 40})
+	defer storageEngine.Shutdown()
+	storageEngine.Set("first", "value")
+
+	var batch WriteBatch
+	batch.Set("a", "some value")
+	batch.Set("b", "another value")
+	shouldEqual(t, storageEngine.Apply(&batch), nil)
+
+	a, _ := storageEngine.offsetMap.get(sha256.Sum256([]byte("a")))
+	b, _ := storageEngine.offsetMap.get(sha256.Sum256([]byte("b")))
+	shouldEqual(t, a.segment, uint32(1))
+	shouldEqual(t, b.segment, uint32(1))
+}
+
+func Test_StorageEngine_Compact_splitsValuesIntoSegments(t *testing.T) {
+	dir := t.TempDir()
+	entryLength := int64(len(encodeDataEntry([]byte("key0"), []byte("value0"))))
+	segmentSize := fileHeaderLength + 2*entryLength
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: segmentSize})
+	for i := 0; i < 6; i++ {
+		storageEngine.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	storageEngine.Delete("key0")
+	storageEngine.Delete("key1")
+	shouldEqual(t, storageEngine.dataSegment, uint32(2))
+
+	err := storageEngine.Compact()
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, len(storageEngine.segments), 2)
+	ids, _ := listSegments(filepath.Join(dir, "data"))
+	shouldEqual(t, ids, []uint32{1})
+	for _, id := range []uint32{0, 1} {
+		shouldEqual(t, pathSize(t, SegmentPath(filepath.Join(dir, "data"), id)), segmentSize)
+	}
+	shouldEqual(t, storageEngine.Set("key6", "value6"), nil)
+	shouldEqual(t, storageEngine.dataSegment, uint32(2))
+	storageEngine.Shutdown()
+
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: segmentSize})
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{})
+	for i := 2; i < 7; i++ {
+		value, _ := storageEngine.Get(fmt.Sprintf("key%d", i))
+		shouldEqual(t, value, []byte(fmt.Sprintf("value%d", i)))
+	}
+}
+
+func Test_StorageEngine_Compact_replacesOldSegmentsWithSameIds(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 30})
+	for i := 0; i < 4; i++ {
+		storageEngine.Set(fmt.Sprintf("key%d", i), "value")
+	}
+	for i := 0; i < 3; i++ {
+		storageEngine.Delete(fmt.Sprintf("key%d", i))
+	}
+
+	shouldEqual(t, storageEngine.Compact(), nil)
+	shouldEqual(t, storageEngine.Set("key4", "value"), nil)
+	shouldEqual(t, storageEngine.dataSegment, uint32(1))
+	storageEngine.Shutdown()
+
+	// segments 2 and 3 held only deleted values, an old one left behind would be taken
+	// for the segment being written to
+	ids, _ := listSegments(filepath.Join(dir, "data"))
+	shouldEqual(t, ids, []uint32{1})
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 30})
+	defer storageEngine.Shutdown()
+	shouldEqual(t, storageEngine.dataSegment, uint32(1))
+	for _, key := range []string{"key3", "key4"} {
+		value, _ := storageEngine.Get(key)
+		shouldEqual(t, value, []byte("value"))
+	}
+}
+
+func Test_recoverFiles_returnsCorruptionErrorWhenSegmentMissing(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 10})
+	storageEngine.Set("a", "value-a")
+	storageEngine.Set("b", "value-b")
+	storageEngine.Set("c", "value-c")
+	storageEngine.Shutdown()
+	os.Remove(SegmentPath(filepath.Join(dir, "data"), 1))
+
+	_, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data")})
+
+	shouldEqual(t, errors.Is(err, ErrCorrupted), true)
+	shouldEqual(t, err, &CorruptionError{"map", fileHeaderLength + mapRecordLength, "data segment 1 is missing"})
+}
+
+func Test_recoverFiles_truncatesOnlyLastSegment(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 10})
+	storageEngine.Set("a", "value-a")
+	storageEngine.Set("b", "value-b")
+	storageEngine.Shutdown()
+	orphan := encodeDataEntry([]byte("c"), []byte("never mapped"))
+	appendToFile(t, SegmentPath(filepath.Join(dir, "data"), 1), orphan)
+
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 10})
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Recovery(), RecoveryReport{DataBytesTruncated: int64(len(orphan))})
+	a, _ := storageEngine.Get("a")
+	shouldEqual(t, a, []byte("value-a"))
+	b, _ := storageEngine.Get("b")
+	shouldEqual(t, b, []byte("value-b"))
+}
+
+func Test_recoverFiles_returnsCorruptionErrorForShortEarlierSegment(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SegmentSize: 40})
+	for _, key := range []string{"a", "b", "c", "d"} {
+		storageEngine.Set(key, "value-"+key)
+	}
+	storageEngine.Shutdown()
+	mapSize := pathSize(t, filepath.Join(dir, "map"))
+	lastSegmentSize := pathSize(t, SegmentPath(filepath.Join(dir, "data"), 3))
+	os.Truncate(filepath.Join(dir, "data"), 40)
+
+	_, err := Open(StorageEngineConfig{MapFilePath: filepath.Join(dir, "map"), DataFilePath: filepath.Join(dir, "data"), SegmentSize: 40})
+
+	shouldEqual(t, err, &CorruptionError{"map", fileHeaderLength, "value runs past the end of data segment 0"})
+	shouldEqual(t, pathSize(t, filepath.Join(dir, "map")), mapSize)
+	shouldEqual(t, pathSize(t, SegmentPath(filepath.Join(dir, "data"), 3)), lastSegmentSize)
+}
+
+func Test_NewStorageEngineWithConfig_needsDataFilePathForSegments(t *testing.T) {
+	dir := t.TempDir()
+	mapFile := openTestFile(t, filepath.Join(dir, "map"))
+	dataFile := openTestFile(t, filepath.Join(dir, "data"))
+
+	_, err := NewStorageEngineWithConfig(mapFile, dataFile, StorageEngineConfig{SegmentSize: 100})
+
+	shouldEqual(t, err, ErrMissingFilePath)
+}
@@ -0,0 +1,313 @@
+package toydb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the server speaks the Redis RESP2 protocol so redis-cli and Redis client libraries
+// can talk to it, supported commands are GET, SET with its EX and PX options, DEL, EXISTS,
+// MGET, MSET, PING and QUIT
+
+var ErrServerClosed = errors.New("toydb: server closed")
+
+type Server struct {
+	engine       *StorageEngine
+	listener     net.Listener
+	mutex        sync.Mutex
+	conns        map[net.Conn]struct{}
+	connsGroup   sync.WaitGroup
+	shuttingDown bool
+}
+
+func NewServer(engine *StorageEngine) *Server {
+	server := new(Server)
+	server.engine = engine
+	server.conns = make(map[net.Conn]struct{})
+	return server
+}
+
+func (srv *Server) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(listener)
+}
+
+func (srv *Server) Serve(listener net.Listener) error {
+	srv.mutex.Lock()
+	if srv.shuttingDown {
+		srv.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	srv.listener = listener
+	srv.mutex.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if srv.isShuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if srv.trackConn(conn) {
+			go srv.handleConn(conn)
+		}
+	}
+}
+
+// Shutdown stops accepting connections, lets every request already read from a
+// connection finish and then shuts down the storage engine
+func (srv *Server) Shutdown() {
+	srv.mutex.Lock()
+	if srv.shuttingDown {
+		srv.mutex.Unlock()
+		return
+	}
+	srv.shuttingDown = true
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	for conn := range srv.conns {
+		// unblocks connections waiting on their next request without cutting off a reply
+		conn.SetReadDeadline(time.Now())
+	}
+	srv.mutex.Unlock()
+	srv.connsGroup.Wait()
+	srv.engine.Shutdown()
+}
+
+func (srv *Server) isShuttingDown() bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.shuttingDown
+}
+
+func (srv *Server) trackConn(conn net.Conn) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.shuttingDown {
+		conn.Close()
+		return false
+	}
+	srv.conns[conn] = struct{}{}
+	srv.connsGroup.Add(1)
+	return true
+}
+
+func (srv *Server) untrackConn(conn net.Conn) {
+	srv.mutex.Lock()
+	delete(srv.conns, conn)
+	srv.mutex.Unlock()
+	conn.Close()
+	srv.connsGroup.Done()
+}
+
+func (srv *Server) handleConn(conn net.Conn) {
+	defer srv.untrackConn(conn)
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	writer := respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if protoErr, ok := err.(protocolError); ok {
+				writer.writeError("ERR " + protoErr.Error())
+				writer.Flush()
+			} else if err != io.EOF && !srv.isShuttingDown() {
+				log.Printf("Error reading from %s: %s\n", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		if args == nil {
+			continue
+		}
+		quit := srv.handleCommand(args, writer)
+		// replies to pipelined requests are batched until the reader runs dry
+		if quit || reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				log.Printf("Error writing to %s: %s\n", conn.RemoteAddr(), err.Error())
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handleCommand writes the reply for one request and reports whether the client asked to quit
+func (srv *Server) handleCommand(args [][]byte, writer respWriter) bool {
+	name := string(args[0])
+	command := strings.ToUpper(name)
+	args = args[1:]
+	switch command {
+	case "GET":
+		if len(args) != 1 {
+			writeArityError(writer, command)
+			return false
+		}
+		value, err := srv.lookup(args[0])
+		if err != nil {
+			writer.writeError("ERR " + err.Error())
+			return false
+		}
+		writer.writeBulk(value)
+	case "SET":
+		if len(args) < 2 {
+			writeArityError(writer, command)
+			return false
+		}
+		ttl, message := parseSetExpiry(args[2:])
+		if message != "" {
+			writer.writeError(message)
+			return false
+		}
+		var err error
+		if ttl > 0 {
+			err = srv.engine.PutWithTTL(args[0], args[1], ttl)
+		} else {
+			err = srv.engine.Put(args[0], args[1])
+		}
+		if err != nil {
+			writer.writeError("ERR " + err.Error())
+			return false
+		}
+		writer.writeSimpleString("OK")
+	case "DEL":
+		if len(args) == 0 {
+			writeArityError(writer, command)
+			return false
+		}
+		var count int64
+		for _, key := range args {
+			exists, err := srv.engine.Exists(key)
+			if err == nil && exists {
+				err = srv.engine.DeleteBytes(key)
+				count++
+			}
+			if err != nil {
+				writer.writeError("ERR " + err.Error())
+				return false
+			}
+		}
+		writer.writeInteger(count)
+	case "EXISTS":
+		if len(args) == 0 {
+			writeArityError(writer, command)
+			return false
+		}
+		var count int64
+		for _, key := range args {
+			exists, err := srv.engine.Exists(key)
+			if err != nil {
+				writer.writeError("ERR " + err.Error())
+				return false
+			}
+			if exists {
+				count++
+			}
+		}
+		writer.writeInteger(count)
+	case "MGET":
+		if len(args) == 0 {
+			writeArityError(writer, command)
+			return false
+		}
+		values := make([][]byte, len(args))
+		for i, key := range args {
+			value, err := srv.lookup(key)
+			if err != nil {
+				writer.writeError("ERR " + err.Error())
+				return false
+			}
+			values[i] = value
+		}
+		writer.writeArrayHeader(len(values))
+		for _, value := range values {
+			writer.writeBulk(value)
+		}
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			writeArityError(writer, command)
+			return false
+		}
+		// a batch so MSET is atomic like it is in Redis
+		var batch WriteBatch
+		for i := 0; i < len(args); i += 2 {
+			batch.Put(args[i], args[i+1])
+		}
+		if err := srv.engine.Apply(&batch); err != nil {
+			writer.writeError("ERR " + err.Error())
+			return false
+		}
+		writer.writeSimpleString("OK")
+	case "PING":
+		switch len(args) {
+		case 0:
+			writer.writeSimpleString("PONG")
+		case 1:
+			writer.writeBulk(args[0])
+		default:
+			writeArityError(writer, command)
+		}
+	case "QUIT":
+		writer.writeSimpleString("OK")
+		return true
+	default:
+		writer.writeError(fmt.Sprintf("ERR unknown command '%s'", name))
+	}
+	return false
+}
+
+// parseSetExpiry reads the EX seconds or PX milliseconds option of SET, the ttl is zero
+// when there is none. A problem comes back as the error message to send
+func parseSetExpiry(options [][]byte) (time.Duration, string) {
+	if len(options) == 0 {
+		return 0, ""
+	}
+	if len(options) != 2 {
+		return 0, "ERR syntax error"
+	}
+	var unit time.Duration
+	switch strings.ToUpper(string(options[0])) {
+	case "EX":
+		unit = time.Second
+	case "PX":
+		unit = time.Millisecond
+	default:
+		return 0, "ERR syntax error"
+	}
+	amount, err := strconv.ParseInt(string(options[1]), 10, 64)
+	if err != nil {
+		return 0, "ERR value is not an integer or out of range"
+	}
+	if amount <= 0 || amount > math.MaxInt64/int64(unit) {
+		return 0, "ERR invalid expire time in 'set' command"
+	}
+	return time.Duration(amount) * unit, ""
+}
+
+func writeArityError(writer respWriter, command string) {
+	writer.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+// lookup turns ErrNotFound into a nil value, which is written as the null bulk string.
+// An empty value is not nil so it is still written as an empty bulk string
+func (srv *Server) lookup(key []byte) ([]byte, error) {
+	value, err := srv.engine.GetBytes(key)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
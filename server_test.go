@@ -0,0 +1,210 @@
+package toydb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestEngine(t *testing.T) *StorageEngine {
+	return openTestEngine(t, t.TempDir())
+}
+
+func startTestServer(t *testing.T) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(newTestEngine(t))
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+func sendRequest(t *testing.T, conn net.Conn, reader *bufio.Reader, request string) string {
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return reply
+}
+
+func runCommand(server *Server, args ...string) string {
+	var buf bytes.Buffer
+	writer := respWriter{bufio.NewWriter(&buf)}
+	argBytes := make([][]byte, len(args))
+	for i, arg := range args {
+		argBytes[i] = []byte(arg)
+	}
+	server.handleCommand(argBytes, writer)
+	writer.Flush()
+	return buf.String()
+}
+
+func Test_Server_handleCommand_setThenGetReturnsValue(t *testing.T) {
+	server := NewServer(newTestEngine(t))
+	defer server.Shutdown()
+
+	shouldEqual(t, runCommand(server, "SET", "testkey", "some\r\ndata"), "+OK\r\n")
+	shouldEqual(t, runCommand(server, "get", "testkey"), "$10\r\nsome\r\ndata\r\n")
+}
+
+func Test_Server_handleCommand_getMissingKeyReturnsNullBulk(t *testing.T) {
+	server := NewServer(newTestEngine(t))
+	defer server.Shutdown()
+
+	shouldEqual(t, runCommand(server, "GET", "missing"), "$-1\r\n")
+}
+
+func Test_Server_handleCommand_msetMgetAndExists(t *testing.T) {
+	server := NewServer(newTestEngine(t))
+	defer server.Shutdown()
+
+	shouldEqual(t, runCommand(server, "MSET", "a", "1", "b", "22"), "+OK\r\n")
+	shouldEqual(t, runCommand(server, "MGET", "a", "missing", "b"), "*3\r\n$1\r\n1\r\n$-1\r\n$2\r\n22\r\n")
+	shouldEqual(t, runCommand(server, "EXISTS", "a", "missing", "b", "a"), ":3\r\n")
+}
+
+func Test_Server_handleCommand_delRemovesKeysAndCountsThem(t *testing.T) {
+	server := NewServer(newTestEngine(t))
+	defer server.Shutdown()
+
+	runCommand(server, "MSET", "a", "1", "b", "2")
+
+	shouldEqual(t, runCommand(server, "DEL", "a", "missing", "b"), ":2\r\n")
+	shouldEqual(t, runCommand(server, "EXISTS", "a", "b"), ":0\r\n")
+}
+
+func Test_Server_handleCommand_delAndExistsWorkForValuesThatCannotBeRead(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{KeyProvider: testKeyRing(1, 1)})
+	storageEngine.Set("secret", "value")
+	storageEngine.Shutdown()
+	// without the KeyProvider the value cannot be decrypted
+	server := NewServer(openTestEngine(t, dir))
+	defer server.Shutdown()
+
+	shouldEqual(t, runCommand(server, "EXISTS", "secret"), ":1\r\n")
+	shouldEqual(t, runCommand(server, "DEL", "secret"), ":1\r\n")
+	shouldEqual(t, runCommand(server, "EXISTS", "secret"), ":0\r\n")
+}
+
+func Test_Server_handleCommand_ping(t *testing.T) {
+	server := NewServer(newTestEngine(t))
+	defer server.Shutdown()
+
+	shouldEqual(t, runCommand(server, "PING"), "+PONG\r\n")
+	shouldEqual(t, runCommand(server, "PING", "hello"), "$5\r\nhello\r\n")
+}
+
+func Test_Server_handleCommand_setWithExpiry(t *testing.T) {
+	server := NewServer(newTestEngine(t))
+	defer server.Shutdown()
+
+	shouldEqual(t, runCommand(server, "SET", "long", "value", "EX", "3600"), "+OK\r\n")
+	shouldEqual(t, runCommand(server, "SET", "short", "value", "px", "1"), "+OK\r\n")
+	time.Sleep(5 * time.Millisecond)
+
+	shouldEqual(t, runCommand(server, "GET", "long"), "$5\r\nvalue\r\n")
+	shouldEqual(t, runCommand(server, "GET", "short"), "$-1\r\n")
+	shouldEqual(t, runCommand(server, "SET", "a", "b", "EX", "0"), "-ERR invalid expire time in 'set' command\r\n")
+	shouldEqual(t, runCommand(server, "SET", "a", "b", "EX", "soon"), "-ERR value is not an integer or out of range\r\n")
+	shouldEqual(t, runCommand(server, "SET", "a", "b", "EX"), "-ERR syntax error\r\n")
+}
+
+func Test_Server_handleCommand_returnsErrorsForBadRequests(t *testing.T) {
+	server := NewServer(newTestEngine(t))
+	defer server.Shutdown()
+
+	shouldEqual(t, runCommand(server, "GET"), "-ERR wrong number of arguments for 'get' command\r\n")
+	shouldEqual(t, runCommand(server, "MSET", "a"), "-ERR wrong number of arguments for 'mset' command\r\n")
+	shouldEqual(t, runCommand(server, "SET", "a", "b", "NX"), "-ERR syntax error\r\n")
+	shouldEqual(t, runCommand(server, "FlushAll"), "-ERR unknown command 'FlushAll'\r\n")
+}
+
+func Test_Server_servesRequestsOverTcp(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	shouldEqual(t, sendRequest(t, conn, reader, "*3\r\n$3\r\nSET\r\n$7\r\ntestkey\r\n$8\r\nsomedata\r\n"), "+OK\r\n")
+	shouldEqual(t, sendRequest(t, conn, reader, "GET testkey\r\n"), "$8\r\n")
+	shouldEqual(t, sendRequest(t, conn, reader, ""), "somedata\r\n")
+	shouldEqual(t, sendRequest(t, conn, reader, "QUIT\r\n"), "+OK\r\n")
+
+	_, err = reader.ReadString('\n')
+	shouldEqual(t, err, io.EOF)
+}
+
+func Test_Server_skipsInlineRequestOfOnlySpaces(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Shutdown()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	shouldEqual(t, sendRequest(t, conn, reader, "   \r\nPING\r\n"), "+PONG\r\n")
+}
+
+func Test_Server_Shutdown_closesIdleConnectionsAndEngine(t *testing.T) {
+	server, address := startTestServer(t)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	shouldEqual(t, sendRequest(t, conn, reader, "SET testkey somedata\r\n"), "+OK\r\n")
+
+	done := make(chan struct{})
+	go (func() {
+		server.Shutdown()
+		close(done)
+	})()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = reader.ReadString('\n')
+	shouldEqual(t, err != nil, true)
+
+	_, err = net.Dial("tcp", address)
+	shouldEqual(t, err != nil, true)
+
+	_, statErr := server.engine.dataFile.Stat()
+	shouldEqual(t, statErr != nil, true)
+}
+
+func Test_Server_Serve_returnsErrServerClosedAfterShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(newTestEngine(t))
+	served := make(chan error)
+	go (func() { served <- server.Serve(listener) })()
+
+	server.Shutdown()
+
+	shouldEqual(t, <-served, ErrServerClosed)
+}
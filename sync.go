@@ -0,0 +1,69 @@
+package toydb
+
+import (
+	"log"
+	"time"
+)
+
+type SyncMode int
+
+const (
+	// SyncNone leaves flushing to the operating system, a power failure can lose recent writes
+	SyncNone SyncMode = iota
+	// SyncAlways syncs both files before every Set or Delete returns
+	SyncAlways
+	// SyncGroupCommit syncs every SyncInterval, writes wait for the next sync so one flush
+	// covers every write made in that interval
+	SyncGroupCommit
+)
+
+// syncTicks starts the clock SyncGroupCommit syncs on and returns a function that stops
+// it, tests swap it for a clock they drive
+var syncTicks = func(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// syncFiles flushes the data file before the map file so a synced map record never
+// points at data that could still be lost
+func (eng *StorageEngine) syncFiles() error {
+	// the data processor can move on to a new segment at any time
+	eng.filesLock.RLock()
+	dataFile := eng.dataFile
+	eng.filesLock.RUnlock()
+	if err := dataFile.Sync(); err != nil {
+		return err
+	}
+	return eng.mapFile.Sync()
+}
+
+// completeWrite answers a write whose map record has been written once it is as durable
+// as the sync mode asks for, it is only called by the map processor
+func (eng *StorageEngine) completeWrite(responseChannel chan error) {
+	switch eng.syncMode {
+	case SyncAlways:
+		err := eng.syncFiles()
+		if err != nil {
+			log.Printf("Error syncing files: %s\n", err.Error())
+		}
+		responseChannel <- err
+	case SyncGroupCommit:
+		eng.pendingSyncs = append(eng.pendingSyncs, responseChannel)
+	default:
+		responseChannel <- nil
+	}
+}
+
+func (eng *StorageEngine) syncPending() {
+	if len(eng.pendingSyncs) == 0 {
+		return
+	}
+	err := eng.syncFiles()
+	if err != nil {
+		log.Printf("Error syncing files: %s\n", err.Error())
+	}
+	for _, responseChannel := range eng.pendingSyncs {
+		responseChannel <- err
+	}
+	eng.pendingSyncs = eng.pendingSyncs[:0]
+}
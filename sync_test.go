@@ -0,0 +1,91 @@
+package toydb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type syncCountingFile struct {
+	*os.File
+	syncs   *int64
+	syncErr error
+}
+
+func (f syncCountingFile) Sync() error {
+	atomic.AddInt64(f.syncs, 1)
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	return f.File.Sync()
+}
+
+func newSyncTestEngine(t *testing.T, config StorageEngineConfig, syncErr error) (*StorageEngine, *int64) {
+	dir := t.TempDir()
+	syncs := new(int64)
+	mapFile := syncCountingFile{openTestFile(t, filepath.Join(dir, "map")), syncs, syncErr}
+	dataFile := syncCountingFile{openTestFile(t, filepath.Join(dir, "data")), syncs, syncErr}
+	storageEngine, err := NewStorageEngineWithConfig(mapFile, dataFile, config)
+	if err != nil {
+		t.Fatalf("Failed to start engine: %v", err)
+	}
+	return storageEngine, syncs
+}
+
+func Test_StorageEngine_Set_doesNotSyncWithSyncNone(t *testing.T) {
+	storageEngine, syncs := newSyncTestEngine(t, StorageEngineConfig{SyncMode: SyncNone}, nil)
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Set("key", "value"), nil)
+	shouldEqual(t, atomic.LoadInt64(syncs), int64(0))
+}
+
+func Test_StorageEngine_Set_syncsBothFilesWithSyncAlways(t *testing.T) {
+	storageEngine, syncs := newSyncTestEngine(t, StorageEngineConfig{SyncMode: SyncAlways}, nil)
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Set("key", "value"), nil)
+	shouldEqual(t, atomic.LoadInt64(syncs), int64(2))
+	shouldEqual(t, storageEngine.Delete("key"), nil)
+	shouldEqual(t, atomic.LoadInt64(syncs), int64(4))
+}
+
+func Test_StorageEngine_Set_returnsErrorWhenSyncFails(t *testing.T) {
+	storageEngine, _ := newSyncTestEngine(t, StorageEngineConfig{SyncMode: SyncAlways}, errors.New("Broken"))
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.Set("key", "value"), &WriteError{"Set", errors.New("Broken")})
+}
+
+func Test_StorageEngine_Set_waitsForGroupCommit(t *testing.T) {
+	ticks := make(chan time.Time)
+	defer func(original func(time.Duration) (<-chan time.Time, func())) { syncTicks = original }(syncTicks)
+	syncTicks = func(time.Duration) (<-chan time.Time, func()) { return ticks, func() {} }
+	storageEngine, syncs := newSyncTestEngine(t, StorageEngineConfig{SyncMode: SyncGroupCommit}, nil)
+	defer storageEngine.Shutdown()
+
+	var writers sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		writers.Add(1)
+		go (func(i int) {
+			defer writers.Done()
+			shouldEqual(t, storageEngine.Set(fmt.Sprintf("key%d", i), "value"), nil)
+		})(i)
+	}
+	// every map record is written before the tick, the map processor only takes the
+	// tick once it has finished with the last of them
+	for fileSize(t, storageEngine.mapFile) < fileHeaderLength+10*mapRecordLength {
+		time.Sleep(time.Millisecond)
+	}
+	shouldEqual(t, atomic.LoadInt64(syncs), int64(0))
+	ticks <- time.Now()
+	writers.Wait()
+
+	// one sync of each file for all 10 writes
+	shouldEqual(t, atomic.LoadInt64(syncs), int64(2))
+}
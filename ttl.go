@@ -0,0 +1,93 @@
+package toydb
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrInvalidTTL = errors.New("toydb: ttl must be positive")
+
+// SetWithTTL is PutWithTTL for string keys and values
+func (eng *StorageEngine) SetWithTTL(key string, value string, ttl time.Duration) error {
+	return eng.putWithTTL(context.Background(), []byte(key), []byte(value), ttl)
+}
+
+// SetWithTTLContext is SetWithTTL that gives up when ctx is done, like SetContext
+func (eng *StorageEngine) SetWithTTLContext(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return eng.putWithTTL(ctx, []byte(key), []byte(value), ttl)
+}
+
+// PutWithTTL is Put for a value that expires once ttl has passed. From then on Get
+// returns ErrNotFound for the key and the sweeper deletes it. The expiry is kept in the
+// key's map record so it still applies after a restart. Setting the key again without a
+// ttl keeps it for good
+func (eng *StorageEngine) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return eng.putWithTTL(context.Background(), key, value, ttl)
+}
+
+func (eng *StorageEngine) putWithTTL(ctx context.Context, key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return eng.putContext(ctx, key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// sweepExpiredKeys looks for expired keys every SweepInterval and hands them to the map
+// processor to delete. Get already treats them as missing, the tombstones are so the keys
+// leave the offset map and compaction drops their values
+func (eng *StorageEngine) sweepExpiredKeys() {
+	ticker := time.NewTicker(eng.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// compaction can swap in a new offset map at any time
+			eng.filesLock.RLock()
+			expired := eng.offsetMap.expired(time.Now().UnixNano())
+			eng.filesLock.RUnlock()
+			if len(expired) == 0 {
+				continue
+			}
+			select {
+			case eng.sweepChannel <- expired:
+			case <-eng.shutdownTriggerChannel:
+				return
+			}
+		case <-eng.shutdownTriggerChannel:
+			return
+		}
+	}
+}
+
+// writeExpiryTombstones is the map processor's half of the sweep. A key that has been set
+// again since the sweeper found it is left alone. The tombstones are not synced, an
+// expired key that comes back after a crash is still expired
+func (eng *StorageEngine) writeExpiryTombstones(expired []indexEntry) {
+	if eng.stoppedError() != nil {
+		return
+	}
+	tombstone := dataInfo{0, 0, tombstoneLength, 0}
+	toWrite := make([]byte, 0, len(expired)*mapRecordLength)
+	stillExpired := expired[:0]
+	for _, entry := range expired {
+		if info, ok := eng.offsetMap.get(entry.key); ok && info == entry.info {
+			toWrite = append(toWrite, encodeMapRecord(entry.key[:], tombstone)...)
+			stillExpired = append(stillExpired, entry)
+		}
+	}
+	if len(stillExpired) == 0 {
+		return
+	}
+	bytesWritten, err := eng.mapFile.Write(toWrite)
+	if err != nil {
+		log.Printf("Error writing expiry tombstones: %s\n", err.Error())
+		eng.undoMapWrite()
+		return
+	}
+	eng.mapFileLength += int64(bytesWritten)
+	for _, entry := range stillExpired {
+		eng.offsetMap.set(entry.key, tombstone)
+	}
+}
@@ -0,0 +1,147 @@
+package toydb
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_StorageEngine_SetWithTTL_getReturnsValueUntilExpired(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{SweepInterval: time.Hour})
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.SetWithTTL("long", "value", time.Hour), nil)
+	shouldEqual(t, storageEngine.SetWithTTL("short", "value", time.Millisecond), nil)
+	time.Sleep(5 * time.Millisecond)
+
+	value, err := storageEngine.Get("long")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("value"))
+	_, err = storageEngine.Get("short")
+	shouldEqual(t, err, ErrNotFound)
+	shouldEqual(t, collectKeys(t, storageEngine.Keys()), []string{"long"})
+}
+
+func Test_StorageEngine_SetWithTTL_returnsErrInvalidTTL(t *testing.T) {
+	storageEngine := newTestEngine(t)
+	defer storageEngine.Shutdown()
+
+	shouldEqual(t, storageEngine.SetWithTTL("key", "value", 0), ErrInvalidTTL)
+	shouldEqual(t, storageEngine.SetWithTTL("key", "value", -time.Second), ErrInvalidTTL)
+}
+
+func Test_StorageEngine_Set_clearsTTL(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{SweepInterval: time.Hour})
+	defer storageEngine.Shutdown()
+
+	storageEngine.SetWithTTL("key", "old", time.Millisecond)
+	storageEngine.Set("key", "new")
+	time.Sleep(5 * time.Millisecond)
+
+	value, err := storageEngine.Get("key")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("new"))
+}
+
+func Test_StorageEngine_SetWithTTL_expirySurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SweepInterval: time.Hour})
+	before := time.Now()
+	storageEngine.SetWithTTL("long", "value", time.Hour)
+	storageEngine.SetWithTTL("short", "value", 20*time.Millisecond)
+	storageEngine.Shutdown()
+
+	mapFile, err := os.Open(filepath.Join(dir, "map"))
+	shouldEqual(t, err, nil)
+	defer mapFile.Close()
+	offsetMap, err := parseOffsetMap(mapFile)
+	shouldEqual(t, err, nil)
+	expiry := offsetMap[sha256.Sum256([]byte("long"))].expiry
+	if expiry < before.Add(time.Hour).UnixNano() || expiry > time.Now().Add(time.Hour).UnixNano() {
+		t.Errorf("expiry %v is not an hour after the Set", time.Unix(0, expiry))
+	}
+
+	// the sweeper does not get to write a tombstone, the expiry alone hides the key
+	time.Sleep(30 * time.Millisecond)
+	os.Remove(HintPath(filepath.Join(dir, "map")))
+	storageEngine = openTestEngineWithConfig(t, dir, StorageEngineConfig{SweepInterval: time.Hour})
+	defer storageEngine.Shutdown()
+	_, err = storageEngine.Get("short")
+	shouldEqual(t, err, ErrNotFound)
+	value, err := storageEngine.Get("long")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("value"))
+}
+
+func Test_StorageEngine_sweeper_writesTombstonesForExpiredKeys(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SweepInterval: time.Millisecond})
+	storageEngine.SetWithTTL("expiring", "value", time.Millisecond)
+	storageEngine.Set("kept", "value")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for storageEngine.offsetMap.len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	storageEngine.Shutdown()
+
+	mapFile, err := os.Open(filepath.Join(dir, "map"))
+	shouldEqual(t, err, nil)
+	defer mapFile.Close()
+	offsetMap, err := parseOffsetMap(mapFile)
+	shouldEqual(t, err, nil)
+	_, ok := offsetMap[sha256.Sum256([]byte("expiring"))]
+	shouldEqual(t, ok, false)
+	_, ok = offsetMap[sha256.Sum256([]byte("kept"))]
+	shouldEqual(t, ok, true)
+}
+
+func Test_StorageEngine_writeExpiryTombstones_skipsKeysSetAgain(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{SweepInterval: time.Hour})
+	defer storageEngine.Shutdown()
+	key := sha256.Sum256([]byte("key"))
+	storageEngine.SetWithTTL("key", "old", time.Millisecond)
+	stale, _ := storageEngine.offsetMap.get(key)
+	storageEngine.Set("key", "new")
+
+	storageEngine.sweepChannel <- []indexEntry{{key, stale}}
+	// the map processor takes work in order, so the sweep is done once this Set is
+	storageEngine.Set("other", "value")
+
+	value, err := storageEngine.Get("key")
+	shouldEqual(t, err, nil)
+	shouldEqual(t, value, []byte("new"))
+}
+
+func Test_StorageEngine_Compact_dropsExpiredValues(t *testing.T) {
+	dir := t.TempDir()
+	storageEngine := openTestEngineWithConfig(t, dir, StorageEngineConfig{SweepInterval: time.Hour})
+	defer storageEngine.Shutdown()
+	storageEngine.SetWithTTL("expiring", "value", time.Millisecond)
+	storageEngine.SetWithTTL("long", "value", time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	err := storageEngine.Compact()
+
+	shouldEqual(t, err, nil)
+	shouldEqual(t, storageEngine.offsetMap.len(), 1)
+	info, _ := storageEngine.offsetMap.get(sha256.Sum256([]byte("long")))
+	shouldEqual(t, info.expiry > time.Now().UnixNano(), true)
+}
+
+func Test_StorageEngine_sweepExpiredKeys_runsAlongsideCompaction(t *testing.T) {
+	storageEngine := openTestEngineWithConfig(t, t.TempDir(), StorageEngineConfig{SweepInterval: time.Millisecond})
+	defer storageEngine.Shutdown()
+
+	for i := 0; i < 5; i++ {
+		storageEngine.SetWithTTL("expiring", "value", time.Millisecond)
+		storageEngine.Set("kept", "value")
+		shouldEqual(t, storageEngine.Compact(), nil)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	value, _ := storageEngine.Get("kept")
+	shouldEqual(t, value, []byte("value"))
+}